@@ -1,6 +1,6 @@
 module github.com/enobufs/go-nats
 
-go 1.12
+go 1.13
 
 require (
 	github.com/pion/logging v0.2.2
@@ -0,0 +1,173 @@
+// Package attr implements the STUN attributes used for NAT behavior
+// discovery that pion/stun does not provide.
+package attr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/pion/stun"
+)
+
+const (
+	familyIPv4 uint16 = 0x01
+	familyIPv6 uint16 = 0x02
+)
+
+// Attribute types
+const (
+	TypeMappedAddress  stun.AttrType = 0x0001 // MAPPED-ADDRESS
+	TypeChangeRequest  stun.AttrType = 0x0003 // CHANGE-REQUEST
+	TypeChangedAddress stun.AttrType = 0x0005 // CHANGED-ADDRESS
+	TypePadding        stun.AttrType = 0x0026 // PADDING
+	TypeResponsePort   stun.AttrType = 0x0027 // RESPONSE-PORT
+	TypeResponseOrigin stun.AttrType = 0x802B // RESPONSE-ORIGIN
+	TypeOtherAddress   stun.AttrType = 0x802C // OTHER-ADDRESS
+)
+
+// Address is the format shared by the address attributes, that is,
+// MAPPED-ADDRESS, CHANGED-ADDRESS, OTHER-ADDRESS and RESPONSE-ORIGIN.
+//
+// RFC 5389 Section 15.1
+type Address struct {
+	IP   net.IP
+	Port int
+}
+
+func (a Address) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
+// GetAs decodes the attribute of type t from m.
+func (a *Address) GetAs(m *stun.Message, t stun.AttrType) error {
+	v, err := m.Get(t)
+	if err != nil {
+		return err
+	}
+	if len(v) <= 4 {
+		return io.ErrUnexpectedEOF
+	}
+	family := binary.BigEndian.Uint16(v[0:2])
+	if family != familyIPv6 && family != familyIPv4 {
+		return fmt.Errorf("xor-mapped address: bad family value %d", family)
+	}
+	ipLen := net.IPv4len
+	if family == familyIPv6 {
+		ipLen = net.IPv6len
+	}
+	if len(v) < 4+ipLen {
+		return io.ErrUnexpectedEOF
+	}
+	// Ensuring len(a.IP) == ipLen and reusing a.IP.
+	if len(a.IP) < ipLen {
+		a.IP = a.IP[:cap(a.IP)]
+		for len(a.IP) < ipLen {
+			a.IP = append(a.IP, 0)
+		}
+	}
+	a.IP = a.IP[:ipLen]
+	for i := range a.IP {
+		a.IP[i] = 0
+	}
+	a.Port = int(binary.BigEndian.Uint16(v[2:4]))
+	copy(a.IP, v[4:4+ipLen])
+	return nil
+}
+
+// AddAs encodes the attribute as type t to m.
+func (a *Address) AddAs(m *stun.Message, t stun.AttrType) error {
+	var (
+		family = familyIPv4
+		ip     = a.IP
+	)
+	if len(a.IP) == net.IPv6len {
+		if ip.To4() != nil {
+			ip = ip[12:16] // like in ip.To4()
+		} else {
+			family = familyIPv6
+		}
+	} else if len(ip) != net.IPv4len {
+		return fmt.Errorf("attrAddr: bad IPv4 length %d", len(ip))
+	}
+	value := make([]byte, 128)
+	value[0] = 0 // first 8 bits are zeroes
+	binary.BigEndian.PutUint16(value[0:2], family)
+	binary.BigEndian.PutUint16(value[2:4], uint16(a.Port))
+	copy(value[4:], ip)
+	m.Add(t, value[:4+len(ip)])
+	return nil
+}
+
+// ChangedAddress represents CHANGED-ADDRESS attribute.
+//
+// RFC 3489 Section 11.2.3
+type ChangedAddress struct {
+	Address
+}
+
+// GetFrom decodes CHANGED-ADDRESS from m.
+func (a *ChangedAddress) GetFrom(m *stun.Message) error {
+	return a.GetAs(m, TypeChangedAddress)
+}
+
+// AddTo encodes CHANGED-ADDRESS to m.
+func (a *ChangedAddress) AddTo(m *stun.Message) error {
+	return a.AddAs(m, TypeChangedAddress)
+}
+
+// OtherAddress represents OTHER-ADDRESS attribute.
+//
+// RFC 5780 Section 7.4
+type OtherAddress struct {
+	Address
+}
+
+// GetFrom decodes OTHER-ADDRESS from m.
+func (a *OtherAddress) GetFrom(m *stun.Message) error {
+	return a.GetAs(m, TypeOtherAddress)
+}
+
+// AddTo encodes OTHER-ADDRESS to m.
+func (a *OtherAddress) AddTo(m *stun.Message) error {
+	return a.AddAs(m, TypeOtherAddress)
+}
+
+// MappedAddress represents MAPPED-ADDRESS attribute.
+//
+// This attribute is used only by servers for achieving backwards
+// compatibility with RFC 3489 clients.
+//
+// RFC 5389 Section 15.1
+type MappedAddress struct {
+	Address
+}
+
+// GetFrom decodes MAPPED-ADDRESS from m.
+func (a *MappedAddress) GetFrom(m *stun.Message) error {
+	return a.GetAs(m, TypeMappedAddress)
+}
+
+// AddTo encodes MAPPED-ADDRESS to m.
+func (a *MappedAddress) AddTo(m *stun.Message) error {
+	return a.AddAs(m, TypeMappedAddress)
+}
+
+// ResponseOrigin represents RESPONSE-ORIGIN attribute.
+//
+// RFC 5780 Section 7.3
+type ResponseOrigin struct {
+	Address
+}
+
+// GetFrom decodes RESPONSE-ORIGIN from m.
+func (a *ResponseOrigin) GetFrom(m *stun.Message) error {
+	return a.GetAs(m, TypeResponseOrigin)
+}
+
+// AddTo encodes RESPONSE-ORIGIN to m.
+func (a *ResponseOrigin) AddTo(m *stun.Message) error {
+	return a.AddAs(m, TypeResponseOrigin)
+}
@@ -0,0 +1,52 @@
+package attr
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddress(t *testing.T) {
+	t.Run("IPv4", func(t *testing.T) {
+		m := new(stun.Message)
+		addr := &Address{IP: net.ParseIP("1.2.3.4"), Port: 3478}
+		assert.NoError(t, addr.AddAs(m, TypeChangedAddress), "should succeed")
+
+		v, err := m.Get(TypeChangedAddress)
+		assert.NoError(t, err, "should succeed")
+		assert.Equal(t, 8, len(v), "should be encoded as IPv4")
+
+		var got Address
+		assert.NoError(t, got.GetAs(m, TypeChangedAddress), "should succeed")
+		assert.True(t, got.IP.Equal(addr.IP), "should match")
+		assert.Equal(t, 3478, got.Port, "should match")
+		assert.Equal(t, "1.2.3.4:3478", got.String(), "should match")
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		m := new(stun.Message)
+		addr := &Address{IP: net.ParseIP("2001:db8::1"), Port: 3479}
+		assert.NoError(t, addr.AddAs(m, TypeOtherAddress), "should succeed")
+
+		v, err := m.Get(TypeOtherAddress)
+		assert.NoError(t, err, "should succeed")
+		assert.Equal(t, 20, len(v), "should be encoded as IPv6")
+
+		var got Address
+		assert.NoError(t, got.GetAs(m, TypeOtherAddress), "should succeed")
+		assert.True(t, got.IP.Equal(addr.IP), "should match")
+		assert.Equal(t, 3479, got.Port, "should match")
+		assert.Equal(t, "[2001:db8::1]:3479", got.String(), "should match")
+	})
+
+	t.Run("Truncated IPv6", func(t *testing.T) {
+		m := new(stun.Message)
+		// IPv6 family with only 4 bytes of address
+		m.Add(TypeOtherAddress, []byte{0x00, 0x02, 0x0d, 0x96, 0x20, 0x01, 0x0d, 0xb8})
+
+		var got Address
+		assert.Error(t, got.GetAs(m, TypeOtherAddress), "should fail")
+	})
+}
@@ -0,0 +1,61 @@
+package attr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pion/stun"
+)
+
+// ChangeRequest represents CHANGE-REQUEST attribute.
+//
+// RFC 5780 Section 7.2
+type ChangeRequest struct {
+	ChangeIP   bool
+	ChangePort bool
+}
+
+func (a *ChangeRequest) String() string {
+	return fmt.Sprintf("changeIP=%v changePort=%v", a.ChangeIP, a.ChangePort)
+}
+
+// GetAs decodes the attribute of type t from m.
+func (a *ChangeRequest) GetAs(m *stun.Message, t stun.AttrType) error {
+	bytes, err := m.Get(t)
+	if err != nil {
+		return err
+	}
+	if len(bytes) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	val := binary.BigEndian.Uint32(bytes[0:4])
+	a.ChangeIP = val&0x4 != 0
+	a.ChangePort = val&0x2 != 0
+	return nil
+}
+
+// AddAs encodes the attribute as type t to m.
+func (a *ChangeRequest) AddAs(m *stun.Message, t stun.AttrType) error {
+	var val uint32
+	if a.ChangeIP {
+		val |= 0x4
+	}
+	if a.ChangePort {
+		val |= 0x2
+	}
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, val)
+	m.Add(t, bytes)
+	return nil
+}
+
+// GetFrom decodes CHANGE-REQUEST from m.
+func (a *ChangeRequest) GetFrom(m *stun.Message) error {
+	return a.GetAs(m, TypeChangeRequest)
+}
+
+// AddTo encodes CHANGE-REQUEST to m.
+func (a *ChangeRequest) AddTo(m *stun.Message) error {
+	return a.AddAs(m, TypeChangeRequest)
+}
@@ -0,0 +1,98 @@
+package attr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/pion/stun"
+)
+
+// TypeMessageIntegritySHA256 is the type of MESSAGE-INTEGRITY-SHA256.
+const TypeMessageIntegritySHA256 stun.AttrType = 0x001C
+
+const (
+	attrHeaderSize       = 4
+	messageHeaderSize    = 20
+	integritySHA256Size  = sha256.Size
+	minIntegritySHA256Sz = 16 // may be truncated down to 16 bytes
+)
+
+// ErrIntegritySHA256Mismatch means that the computed HMAC differs from the
+// one in MESSAGE-INTEGRITY-SHA256.
+var ErrIntegritySHA256Mismatch = errors.New("MESSAGE-INTEGRITY-SHA256 check failed")
+
+// MessageIntegritySHA256 represents MESSAGE-INTEGRITY-SHA256 attribute, the
+// key of which is derived from the credentials as with MESSAGE-INTEGRITY.
+// Only the MD5 password algorithm is supported for the long-term credential
+// mechanism, that is, the key is the same as stun.NewLongTermIntegrity's.
+//
+// RFC 8489 Section 14.6
+type MessageIntegritySHA256 []byte
+
+func (i MessageIntegritySHA256) String() string {
+	return fmt.Sprintf("KEY: 0x%x", []byte(i))
+}
+
+// AddTo adds MESSAGE-INTEGRITY-SHA256 to m. It must come after
+// MESSAGE-INTEGRITY, if any, and before FINGERPRINT.
+func (i MessageIntegritySHA256) AddTo(m *stun.Message) error {
+	if m.Contains(stun.AttrFingerprint) {
+		return stun.ErrFingerprintBeforeIntegrity
+	}
+
+	// The HMAC covers the message up to the attribute, with the length in
+	// the header including the attribute.
+	length := m.Length
+	m.Length += integritySHA256Size + attrHeaderSize
+	m.WriteLength()
+	v := i.hmac(m.Raw)
+	m.Length = length
+
+	m.Add(TypeMessageIntegritySHA256, v)
+	return nil
+}
+
+// Check verifies MESSAGE-INTEGRITY-SHA256 of m.
+func (i MessageIntegritySHA256) Check(m *stun.Message) error {
+	v, err := m.Get(TypeMessageIntegritySHA256)
+	if err != nil {
+		return err
+	}
+	if len(v) < minIntegritySHA256Sz || len(v) > integritySHA256Size || len(v)%4 != 0 {
+		return ErrIntegritySHA256Mismatch
+	}
+
+	// Exclude the attributes after MESSAGE-INTEGRITY-SHA256 from the length
+	var (
+		length         = m.Length
+		afterIntegrity = false
+		sizeReduced    int
+	)
+	for _, a := range m.Attributes {
+		if afterIntegrity {
+			sizeReduced += attrHeaderSize + (int(a.Length)+3)&^3
+		}
+		if a.Type == TypeMessageIntegritySHA256 {
+			afterIntegrity = true
+		}
+	}
+	m.Length -= uint32(sizeReduced)
+	m.WriteLength()
+	start := messageHeaderSize + int(m.Length) - (attrHeaderSize + len(v))
+	expected := i.hmac(m.Raw[:start])
+	m.Length = length
+	m.WriteLength()
+
+	if !hmac.Equal(v, expected[:len(v)]) {
+		return ErrIntegritySHA256Mismatch
+	}
+	return nil
+}
+
+func (i MessageIntegritySHA256) hmac(b []byte) []byte {
+	mac := hmac.New(sha256.New, i)
+	mac.Write(b) // nolint:errcheck,gosec
+	return mac.Sum(nil)
+}
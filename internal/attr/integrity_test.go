@@ -0,0 +1,66 @@
+package attr
+
+import (
+	"testing"
+
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageIntegritySHA256(t *testing.T) {
+	key := MessageIntegritySHA256(stun.NewLongTermIntegrity("user", "realm", "pass"))
+
+	t.Run("With MESSAGE-INTEGRITY and FINGERPRINT", func(t *testing.T) {
+		m, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+			stun.NewUsername("user"),
+			stun.MessageIntegrity(key),
+			key,
+			stun.Fingerprint)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		decoded := &stun.Message{Raw: append([]byte{}, m.Raw...)}
+		if !assert.NoError(t, decoded.Decode(), "should succeed") {
+			return
+		}
+		assert.NoError(t, key.Check(decoded), "should succeed")
+		assert.NoError(t, stun.MessageIntegrity(key).Check(decoded), "should succeed")
+		assert.NoError(t, stun.Fingerprint.Check(decoded), "should succeed")
+
+		wrong := MessageIntegritySHA256(stun.NewLongTermIntegrity("user", "realm", "wrong"))
+		assert.Equal(t, ErrIntegritySHA256Mismatch, wrong.Check(decoded), "should fail")
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		m, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+			stun.NewUsername("user"),
+			key)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		m.Raw[len(m.Raw)-40] ^= 0x01 // within USERNAME
+		decoded := &stun.Message{Raw: m.Raw}
+		if !assert.NoError(t, decoded.Decode(), "should succeed") {
+			return
+		}
+		assert.Equal(t, ErrIntegritySHA256Mismatch, key.Check(decoded), "should fail")
+	})
+
+	t.Run("After FINGERPRINT", func(t *testing.T) {
+		m, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.Equal(t, stun.ErrFingerprintBeforeIntegrity, key.AddTo(m), "should fail")
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		m, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.Equal(t, stun.ErrAttributeNotFound, key.Check(m), "should fail")
+	})
+}
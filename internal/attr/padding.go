@@ -0,0 +1,47 @@
+package attr
+
+import (
+	"strconv"
+
+	"github.com/pion/stun"
+)
+
+// Padding represents PADDING attribute.
+//
+// The content is free-format and only its length matters. It is used to make
+// the message large enough to be fragmented.
+//
+// RFC 5780 Section 7.6
+type Padding struct {
+	Length int
+}
+
+func (a *Padding) String() string {
+	return strconv.Itoa(a.Length)
+}
+
+// GetAs decodes the attribute of type t from m.
+func (a *Padding) GetAs(m *stun.Message, t stun.AttrType) error {
+	bytes, err := m.Get(t)
+	if err != nil {
+		return err
+	}
+	a.Length = len(bytes)
+	return nil
+}
+
+// AddAs encodes the attribute as type t to m.
+func (a *Padding) AddAs(m *stun.Message, t stun.AttrType) error {
+	m.Add(t, make([]byte, a.Length))
+	return nil
+}
+
+// GetFrom decodes PADDING from m.
+func (a *Padding) GetFrom(m *stun.Message) error {
+	return a.GetAs(m, TypePadding)
+}
+
+// AddTo encodes PADDING to m.
+func (a *Padding) AddTo(m *stun.Message) error {
+	return a.AddAs(m, TypePadding)
+}
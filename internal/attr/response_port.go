@@ -0,0 +1,54 @@
+package attr
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+
+	"github.com/pion/stun"
+)
+
+// ResponsePort represents RESPONSE-PORT attribute.
+//
+// The server sends the response to the source IP address of the request and
+// this port, instead of the source port of the request.
+//
+// RFC 5780 Section 7.5
+type ResponsePort struct {
+	Port int
+}
+
+func (a *ResponsePort) String() string {
+	return strconv.Itoa(a.Port)
+}
+
+// GetAs decodes the attribute of type t from m.
+func (a *ResponsePort) GetAs(m *stun.Message, t stun.AttrType) error {
+	bytes, err := m.Get(t)
+	if err != nil {
+		return err
+	}
+	if len(bytes) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	a.Port = int(binary.BigEndian.Uint16(bytes[0:2]))
+	return nil
+}
+
+// AddAs encodes the attribute as type t to m.
+func (a *ResponsePort) AddAs(m *stun.Message, t stun.AttrType) error {
+	bytes := make([]byte, 4) // port followed by 2 bytes of padding
+	binary.BigEndian.PutUint16(bytes[0:2], uint16(a.Port))
+	m.Add(t, bytes)
+	return nil
+}
+
+// GetFrom decodes RESPONSE-PORT from m.
+func (a *ResponsePort) GetFrom(m *stun.Message) error {
+	return a.GetAs(m, TypeResponsePort)
+}
+
+// AddTo encodes RESPONSE-PORT to m.
+func (a *ResponsePort) AddTo(m *stun.Message) error {
+	return a.AddAs(m, TypeResponsePort)
+}
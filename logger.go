@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+)
+
+// jsonLoggerFactory creates loggers writing one JSON object per line, for
+// log collectors to parse.
+type jsonLoggerFactory struct {
+	level  logging.LogLevel
+	writer io.Writer
+	mutex  sync.Mutex
+}
+
+func newJSONLoggerFactory(w io.Writer, level string) (*jsonLoggerFactory, error) {
+	levels := map[string]logging.LogLevel{
+		"disable": logging.LogLevelDisabled,
+		"error":   logging.LogLevelError,
+		"warn":    logging.LogLevelWarn,
+		"info":    logging.LogLevelInfo,
+		"debug":   logging.LogLevelDebug,
+		"trace":   logging.LogLevelTrace,
+	}
+
+	l, ok := levels[strings.ToLower(level)]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level: %s", level)
+	}
+
+	return &jsonLoggerFactory{level: l, writer: w}, nil
+}
+
+func (f *jsonLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	return &jsonLogger{factory: f, scope: scope}
+}
+
+func (f *jsonLoggerFactory) write(level logging.LogLevel, scope, msg string) {
+	if level > f.level {
+		return
+	}
+
+	bytes, err := json.Marshal(struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Scope string `json:"scope"`
+		Msg   string `json:"msg"`
+	}{
+		Time:  time.Now().UTC().Format(time.RFC3339Nano),
+		Level: strings.ToLower(level.String()),
+		Scope: scope,
+		Msg:   msg,
+	})
+	if err != nil {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.writer.Write(append(bytes, '\n')) // nolint:errcheck,gosec
+}
+
+type jsonLogger struct {
+	factory *jsonLoggerFactory
+	scope   string
+}
+
+func (l *jsonLogger) Trace(msg string) { l.factory.write(logging.LogLevelTrace, l.scope, msg) }
+func (l *jsonLogger) Tracef(format string, args ...interface{}) {
+	l.Trace(fmt.Sprintf(format, args...))
+}
+func (l *jsonLogger) Debug(msg string) { l.factory.write(logging.LogLevelDebug, l.scope, msg) }
+func (l *jsonLogger) Debugf(format string, args ...interface{}) {
+	l.Debug(fmt.Sprintf(format, args...))
+}
+func (l *jsonLogger) Info(msg string) { l.factory.write(logging.LogLevelInfo, l.scope, msg) }
+func (l *jsonLogger) Infof(format string, args ...interface{}) {
+	l.Info(fmt.Sprintf(format, args...))
+}
+func (l *jsonLogger) Warn(msg string) { l.factory.write(logging.LogLevelWarn, l.scope, msg) }
+func (l *jsonLogger) Warnf(format string, args ...interface{}) {
+	l.Warn(fmt.Sprintf(format, args...))
+}
+func (l *jsonLogger) Error(msg string) { l.factory.write(logging.LogLevelError, l.scope, msg) }
+func (l *jsonLogger) Errorf(format string, args ...interface{}) {
+	l.Error(fmt.Sprintf(format, args...))
+}
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 
 	"github.com/enobufs/go-nats/nats"
+	"github.com/enobufs/go-nats/server"
+	"github.com/pion/stun"
 )
 
 func check(err error) {
@@ -16,19 +26,339 @@ func check(err error) {
 	}
 }
 
+// Splits a comma-separated list, returning nil for an empty string.
+func splitList(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// Parses "username:password", defaulting to $GO_NATS_CREDENTIALS. Returns nil
+// if neither is given.
+func parseCredentials(s string, longTerm, sha256 bool) *nats.Credentials {
+	if len(s) == 0 {
+		s = os.Getenv("GO_NATS_CREDENTIALS")
+	}
+	if len(s) == 0 {
+		return nil
+	}
+
+	i := strings.Index(s, ":")
+	if i < 0 {
+		check(fmt.Errorf("credentials must be username:password"))
+	}
+
+	return &nats.Credentials{
+		Username: s[:i],
+		Password: s[i+1:],
+		LongTerm: longTerm,
+		SHA256:   sha256,
+	}
+}
+
+// Parses comma-separated "username:password" pairs.
+func parseUsers(s string) map[string]string {
+	users := map[string]string{}
+	for _, pair := range splitList(s) {
+		i := strings.Index(pair, ":")
+		if i < 0 {
+			check(fmt.Errorf("users must be username:password"))
+		}
+		users[pair[:i]] = pair[i+1:]
+	}
+	return users
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// Runs the probe subcommand: go-nats probe [flags] server...
+func probe(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "Verbose")
+	ipv6 := fs.Bool("6", false, "Probe over IPv6.")
+	asJSON := fs.Bool("j", false, "Print the results in JSON.")
+	creds := fs.String("u", "", "Credentials (username:password) for the servers. (defaults to $GO_NATS_CREDENTIALS)")
+	longTerm := fs.Bool("l", false, "Use the long-term credential mechanism.")
+	sha256 := fs.Bool("sha256", false, "Add MESSAGE-INTEGRITY-SHA256, and require it in responses.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s probe [flags] server...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	servers := fs.Args()
+	if len(servers) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	network := "udp4"
+	if *ipv6 {
+		network = "udp6"
+	}
+
+	credentials := parseCredentials(*creds, *longTerm, *sha256)
+
+	results := make([]*nats.ProbeResult, len(servers))
+	errs := make([]error, len(servers))
+
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			n, err := nats.NewNATS(&nats.Config{
+				Server:      server,
+				Verbose:     *verbose,
+				Network:     network,
+				Credentials: credentials,
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer n.Close()
+			results[i], errs[i] = n.Probe(context.Background())
+		}(i, server)
+	}
+	wg.Wait()
+
+	if *asJSON {
+		type entry struct {
+			Server string            `json:"server"`
+			Result *nats.ProbeResult `json:"result,omitempty"`
+			Error  string            `json:"error,omitempty"`
+		}
+		entries := make([]entry, len(servers))
+		for i, server := range servers {
+			entries[i] = entry{Server: server, Result: results[i]}
+			if errs[i] != nil {
+				entries[i].Error = errs[i].Error()
+			}
+		}
+		bytes, err := json.MarshalIndent(entries, "", "  ")
+		check(err)
+		fmt.Println(string(bytes))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tXOR-MAPPED\tOTHER\tCHANGED\tCHANGE-IP\tCHANGE-PORT\tRESP-ORIGIN\tRESP-PORT\tPADDING\tFINGERPRINT\tRFC5780")
+	for i, server := range servers {
+		if errs[i] != nil {
+			fmt.Fprintf(w, "%s\terror: %s\n", server, errs[i].Error())
+			continue
+		}
+		r := results[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			server,
+			yesNo(r.XORMappedAddress),
+			yesNo(r.OtherAddress),
+			yesNo(r.ChangedAddress),
+			yesNo(r.ChangeIP),
+			yesNo(r.ChangePort),
+			yesNo(r.ResponseOrigin),
+			yesNo(r.ResponsePort),
+			yesNo(r.Padding),
+			yesNo(r.Fingerprint),
+			yesNo(r.SupportsRFC5780()))
+	}
+	w.Flush()
+}
+
+// Runs the serve subcommand: go-nats serve [flags]. The error is returned
+// once the server and the metrics endpoint have been shut down.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	primary := fs.String("primary", "", "Primary address (IP:port) to listen on. The port defaults to 3478.")
+	secondary := fs.String("secondary", "", "Secondary address (IP:port) to listen on. The port defaults to 3479.")
+	software := fs.String("software", "go-nats", "SOFTWARE attribute to send. (empty to send none)")
+	changedAddr := fs.Bool("changed-address", false, "Also send CHANGED-ADDRESS for RFC 3489 clients.")
+	logLevel := fs.String("log-level", "info", "Log level: error, warn, info, debug or trace.")
+	rate := fs.Float64("rate", 10, "Requests per second handled from each source IP address. (0 for no limit)")
+	burst := fs.Int("burst", 20, "Requests handled at once from each source IP address.")
+	globalRate := fs.Float64("global-rate", 10000, "Requests per second handled in total. (0 for no limit)")
+	allow := fs.String("allow", "", "Comma-separated CIDRs to handle requests from. (empty for anywhere)")
+	deny := fs.String("deny", "", "Comma-separated CIDRs to drop requests from.")
+	maxResponseSize := fs.Int("max-response-size", 1400, "Size in bytes beyond which responses are not sent. (negative for no limit)")
+	metricsAddr := fs.String("metrics", "", "Address (e.g. :9100) to serve Prometheus metrics at /metrics on. (empty to disable)")
+	peer := fs.String("peer", "", "Control channel address (IP:port) of the peer, for the distributed mode.")
+	control := fs.String("control", "", "Address (IP:port) to listen on for the control channel from the peer.")
+	peerSecret := fs.String("peer-secret", "", "Secret shared with the peer. (defaults to $GO_NATS_PEER_SECRET)")
+	users := fs.String("users", "", "Comma-separated username:password to require authentication with. (defaults to $GO_NATS_USERS)")
+	realm := fs.String("realm", "", "Realm for the long-term credential mechanism. (empty for short-term)")
+	useTCP := fs.Bool("tcp", false, "Also listen on TCP at the primary and secondary addresses.")
+	tlsCert := fs.String("tls-cert", "", "Certificate file (PEM) to listen on TLS with. (requires -tls-key)")
+	tlsKey := fs.String("tls-key", "", "Private key file (PEM) of the certificate.")
+	tlsPort := fs.Int("tls-port", 5349, "TLS port on the primary IP address. (443 to pass through firewalls)")
+	tlsSecondaryPort := fs.Int("tls-secondary-port", 5350, "TLS port on the secondary IP address.")
+	maxConns := fs.Int("max-connections", 1000, "TCP and TLS connections open at once.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(*primary) == 0 || len(*secondary) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	loggerFactory, err := newJSONLoggerFactory(os.Stderr, *logLevel)
+	if err != nil {
+		return err
+	}
+
+	altAttrs := []stun.AttrType{server.AttrTypeOtherAddress}
+	if *changedAddr {
+		altAttrs = append(altAttrs, server.AttrTypeChangedAddress)
+	}
+
+	var peerConfig *server.PeerConfig
+	if len(*peer) > 0 {
+		secret := *peerSecret
+		if len(secret) == 0 {
+			secret = os.Getenv("GO_NATS_PEER_SECRET")
+		}
+		peerConfig = &server.PeerConfig{
+			ListenAddress: *control,
+			Address:       *peer,
+			Secret:        []byte(secret),
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if len(*tlsCert) > 0 || len(*tlsKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	var authConfig *server.AuthConfig
+	if len(*users) == 0 {
+		*users = os.Getenv("GO_NATS_USERS")
+	}
+	if len(*users) > 0 {
+		authConfig = &server.AuthConfig{
+			Users: parseUsers(*users),
+			Realm: *realm,
+		}
+	}
+
+	s, err := server.NewServer(&server.Config{
+		PrimaryAddress:        *primary,
+		SecondaryAddress:      *secondary,
+		Software:              *software,
+		AlternateAddressAttrs: altAttrs,
+		PerSourceRate:         *rate,
+		PerSourceBurst:        *burst,
+		GlobalRate:            *globalRate,
+		AllowCIDRs:            splitList(*allow),
+		DenyCIDRs:             splitList(*deny),
+		MaxResponseSize:       *maxResponseSize,
+		TCP:                   *useTCP,
+		TLSConfig:             tlsConfig,
+		TLSPrimaryPort:        *tlsPort,
+		TLSSecondaryPort:      *tlsSecondaryPort,
+		MaxConnections:        *maxConns,
+		Peer:                  peerConfig,
+		Auth:                  authConfig,
+		LoggerFactory:         loggerFactory,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	if len(*metricsAddr) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.MetricsHandler())
+		httpServer := &http.Server{Addr: *metricsAddr, Handler: mux}
+
+		go func() {
+			if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "Error: metrics: %s\n", err.Error())
+				cancel()
+			}
+		}()
+		defer httpServer.Close()
+	}
+
+	return s.Serve(ctx)
+}
+
 func main() {
-	server := flag.String("s", "stun.sipgate.net:3478", "STUN server address.")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "probe":
+			probe(os.Args[2:])
+			return
+		case "serve":
+			check(serve(os.Args[2:]))
+			return
+		}
+	}
+
+	server := flag.String("s", "stun.sipgate.net:3478", "STUN server address. (comma-separated for multiple servers)")
 	verbose := flag.Bool("v", false, "Verbose")
+	ipv6 := flag.Bool("6", false, "Discover over IPv6.")
+	dualStack := flag.Bool("a", false, "Discover over both IPv4 and IPv6.")
+	portProbes := flag.Int("p", 0, "Number of sockets for port allocation analysis.")
+	algorithm := flag.String("m", nats.AlgorithmRFC5780, "Discovery algorithm: rfc5780, rfc3489 or auto.")
+	useTCP := flag.Bool("t", false, "Discover the mapping behavior over TCP instead.")
+	creds := flag.String("u", "", "Credentials (username:password) for the server. (defaults to $GO_NATS_CREDENTIALS)")
+	longTerm := flag.Bool("l", false, "Use the long-term credential mechanism.")
+	sha256 := flag.Bool("sha256", false, "Add MESSAGE-INTEGRITY-SHA256, and require it in responses.")
+	trace := flag.Bool("trace", false, "Include every request sent in the result.")
 
 	flag.Parse()
 
+	network := "udp4"
+	if *ipv6 {
+		network = "udp6"
+	}
+
+	protocol := nats.ProtocolUDP
+	if *useTCP {
+		protocol = nats.ProtocolTCP
+	}
+
 	n, err := nats.NewNATS(&nats.Config{
-		Server:  *server,
-		Verbose: *verbose,
+		Servers:              strings.Split(*server, ","),
+		Verbose:              *verbose,
+		Network:              network,
+		PortAllocationProbes: *portProbes,
+		Algorithm:            *algorithm,
+		Protocol:             protocol,
+		Credentials:          parseCredentials(*creds, *longTerm, *sha256),
+		Trace:                *trace,
 	})
 	check(err)
+	defer n.Close()
 
-	res, err := n.Discover()
+	var res interface{}
+	if *dualStack {
+		res, err = n.DiscoverAll(context.Background())
+	} else {
+		res, err = n.Discover()
+	}
 	check(err)
 
 	bytes, err := json.MarshalIndent(res, "", "  ")
@@ -0,0 +1,140 @@
+package nats
+
+import (
+	"sync"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/stun"
+)
+
+// Credentials for STUN servers requiring authentication. (RFC 8489 Section 9)
+type Credentials struct {
+	Username string
+	Password string
+	// LongTerm selects the long-term credential mechanism, where the server
+	// challenges the first request with 401 giving REALM and NONCE.
+	// Otherwise the short-term mechanism is used, and every request carries
+	// the credentials.
+	LongTerm bool
+	// SHA256 adds MESSAGE-INTEGRITY-SHA256 of RFC 8489 after
+	// MESSAGE-INTEGRITY, and requires it in responses.
+	SHA256 bool
+}
+
+// authenticator signs requests with the credentials, and keeps the realm and
+// nonce given by the server for the long-term credential mechanism.
+type authenticator struct {
+	creds Credentials
+	mutex sync.Mutex
+	realm string
+	nonce string
+}
+
+func newAuthenticator(creds *Credentials) *authenticator {
+	if creds == nil {
+		return nil
+	}
+	return &authenticator{creds: *creds}
+}
+
+// Returns the key, or nil while the realm is not known yet with the long-term
+// credential mechanism.
+func (a *authenticator) key() (key []byte, realm, nonce string) {
+	if !a.creds.LongTerm {
+		return stun.NewShortTermIntegrity(a.creds.Password), "", ""
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.realm) == 0 {
+		return nil, "", ""
+	}
+	return stun.NewLongTermIntegrity(a.creds.Username, a.realm, a.creds.Password), a.realm, a.nonce
+}
+
+// Returns a copy of msg with the credentials added. The transaction ID is
+// renewed on retries after a challenge.
+func (a *authenticator) sign(msg *stun.Message, retry bool) (*stun.Message, error) {
+	m := &stun.Message{Raw: append([]byte{}, msg.Raw...)}
+	if err := m.Decode(); err != nil {
+		return nil, err
+	}
+	if retry {
+		if err := m.NewTransactionID(); err != nil {
+			return nil, err
+		}
+	}
+
+	key, realm, nonce := a.key()
+	if key == nil {
+		return m, nil // to be challenged
+	}
+
+	setters := []stun.Setter{stun.NewUsername(a.creds.Username)}
+	if len(realm) > 0 {
+		setters = append(setters, stun.NewRealm(realm), stun.NewNonce(nonce))
+	}
+	setters = append(setters, stun.MessageIntegrity(key))
+	if a.creds.SHA256 {
+		setters = append(setters, attr.MessageIntegritySHA256(key))
+	}
+
+	for _, s := range setters {
+		if err := s.AddTo(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Learns the realm and nonce from an error response. Returns true if the
+// request should be retried with them, that is, with the long-term
+// credential mechanism on 401 or 438 (Stale Nonce).
+func (a *authenticator) challenged(res *stun.Message) bool {
+	if !a.creds.LongTerm {
+		return false
+	}
+
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(res); err != nil {
+		return false
+	}
+	if code.Code != stun.CodeUnauthorized && code.Code != stun.CodeStaleNonce {
+		return false
+	}
+
+	var realm stun.Realm
+	var nonce stun.Nonce
+	if err := realm.GetFrom(res); err != nil {
+		return false
+	}
+	if err := nonce.GetFrom(res); err != nil {
+		return false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.realm = realm.String()
+	a.nonce = nonce.String()
+	return true
+}
+
+// Verifies the integrity of a success response.
+func (a *authenticator) check(res *stun.Message) error {
+	key, _, _ := a.key()
+	if key == nil {
+		return ErrIntegrityMismatch
+	}
+
+	if a.creds.SHA256 {
+		if err := attr.MessageIntegritySHA256(key).Check(res); err != nil {
+			return ErrIntegrityMismatch
+		}
+		return nil
+	}
+
+	if err := stun.MessageIntegrity(key).Check(res); err != nil {
+		return ErrIntegrityMismatch
+	}
+	return nil
+}
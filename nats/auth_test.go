@@ -0,0 +1,112 @@
+package nats
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/enobufs/go-nats/server"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverWithCredentials(t *testing.T) {
+	natType := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
+	}
+	users := map[string]string{"alice": "secret"}
+
+	testCases := []struct {
+		name  string
+		realm string
+		creds *Credentials
+		err   error
+	}{
+		{
+			name:  "Short-term",
+			creds: &Credentials{Username: "alice", Password: "secret"},
+		},
+		{
+			name:  "Short-term with SHA-256",
+			creds: &Credentials{Username: "alice", Password: "secret", SHA256: true},
+		},
+		{
+			name:  "Long-term",
+			realm: "example.org",
+			creds: &Credentials{Username: "alice", Password: "secret", LongTerm: true},
+		},
+		{
+			name:  "Long-term with SHA-256",
+			realm: "example.org",
+			creds: &Credentials{Username: "alice", Password: "secret", LongTerm: true, SHA256: true},
+		},
+		{
+			name:  "No credentials",
+			realm: "example.org",
+			err:   ErrUnauthorized,
+		},
+		{
+			name:  "Wrong password",
+			realm: "example.org",
+			creds: &Credentials{Username: "alice", Password: "wrong", LongTerm: true},
+			err:   ErrUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := buildVNetWithServer(natType, func(config *server.Config) {
+				config.Auth = &server.AuthConfig{Users: users, Realm: tc.realm}
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+
+			nats, err := NewNATS(&Config{
+				Server:             "stun.pion.net:3478",
+				Net:                v.net0,
+				TransactionTimeout: 300 * time.Millisecond,
+				Credentials:        tc.creds,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			res, err := nats.Discover()
+			if tc.err != nil {
+				assert.True(t, errors.Is(err, tc.err), "should match")
+				return
+			}
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			assert.Equal(t, NATTypePortRestrictedCone, res.NATType, "should match")
+			assert.Equal(t, EndpointAddrPortDependent, res.FilteringBehavior, "should match")
+		})
+	}
+
+	t.Run("Unsigned response", func(t *testing.T) {
+		v, err := buildVNetWithServer(natType, nil)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 300 * time.Millisecond,
+			Credentials:        &Credentials{Username: "alice", Password: "secret"},
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		_, err = nats.Discover()
+		assert.True(t, errors.Is(err, ErrIntegrityMismatch), "should fail")
+	})
+}
@@ -0,0 +1,200 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/stun"
+)
+
+const (
+	defaultBindingLifetimeMin        = time.Second
+	defaultBindingLifetimeMax        = 2 * time.Minute
+	defaultBindingLifetimeResolution = time.Second
+)
+
+// Clock tells the time and waits for it to pass. It is used by
+// DiscoverBindingLifetime so that the idle periods can be simulated.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// BindingLifetimeResult contains a set of results from DiscoverBindingLifetime
+// method. The binding lifetime lies between Lifetime and UpperBound.
+type BindingLifetimeResult struct {
+	// Longest idle period the binding was found to survive. Zero if it did
+	// not survive the lower bound of the search.
+	Lifetime time.Duration `json:"lifetime"`
+	// Shortest idle period the binding was found to expire after. Zero if it
+	// survived the upper bound of the search.
+	UpperBound time.Duration `json:"upperBound"`
+	// Number of idle periods tested
+	Probes int `json:"probes"`
+}
+
+// DiscoverBindingLifetime finds how long the NAT keeps a UDP binding that has
+// no outbound traffic, as described in RFC 5780 Section 4.6. The idle period
+// is searched for by binary search between Config.BindingLifetimeMin and
+// Config.BindingLifetimeMax, which takes a while as each probe actually waits
+// for the period to elapse.
+//
+// Each probe refreshes the binding of a socket X, waits for the idle period,
+// then sends a Binding request from another socket Y with RESPONSE-PORT set
+// to the mapped port of X. The server sends the response to the NAT's address
+// and that port, which reaches X only if the binding is still alive. The
+// server must support RESPONSE-PORT.
+//
+// With multiple servers, only the first one is used.
+func (nats *NATS) DiscoverBindingLifetime(ctx context.Context) (*BindingLifetimeResult, error) {
+	if nats.serverAddr == nil {
+		n, err := nats.withServer(nats.network, nats.server)
+		if err != nil {
+			return nil, err
+		}
+		return n.DiscoverBindingLifetime(ctx)
+	}
+
+	ctx, cancel, err := nats.res.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	res, err := nats.discoverBindingLifetime(ctx)
+	nats.phaseCompleted("binding lifetime discovery", err)
+	return res, err
+}
+
+// Discovers the binding lifetime as DiscoverBindingLifetime does.
+func (nats *NATS) discoverBindingLifetime(ctx context.Context) (*BindingLifetimeResult, error) {
+	if nats.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nats.timeout)
+		defer cancel()
+	}
+
+	connX, err := nats.listenPacket()
+	if err != nil {
+		return nil, err
+	}
+	defer connX.Close()
+
+	connY, err := nats.listenPacket()
+	if err != nil {
+		return nil, err
+	}
+	defer connY.Close()
+
+	res := &BindingLifetimeResult{}
+
+	probe := func(idle time.Duration) (bool, error) {
+		res.Probes++
+		alive, err := nats.probeBinding(ctx, connX, connY, idle)
+		if err != nil {
+			return false, nats.probeError("binding lifetime discovery", res.Probes-1, nats.serverAddr, err)
+		}
+		nats.log.Debugf("binding alive after %v: %v", idle, alive)
+		return alive, nil
+	}
+
+	lo := nats.bindingLifetimeMin
+	hi := nats.bindingLifetimeMax
+
+	alive, err := probe(hi)
+	if err != nil {
+		return nil, err
+	}
+	if alive {
+		res.Lifetime = hi
+		return res, nil
+	}
+
+	alive, err = probe(lo)
+	if err != nil {
+		return nil, err
+	}
+	if !alive {
+		res.UpperBound = lo
+		return res, nil
+	}
+
+	for hi-lo > nats.bindingLifetimeResolution {
+		mid := lo + (hi-lo)/2
+		alive, err = probe(mid)
+		if err != nil {
+			return nil, err
+		}
+		if alive {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	res.Lifetime = lo
+	res.UpperBound = hi
+	return res, nil
+}
+
+// Tells whether the binding of connX survives the given idle period.
+func (nats *NATS) probeBinding(ctx context.Context, connX, connY net.PacketConn, idle time.Duration) (bool, error) {
+	// Create or refresh the binding of X
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return false, err
+	}
+
+	trRes, err := nats.roundTrip(ctx, connX, msg, nats.serverAddr, "binding lifetime discovery")
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, contextError(ctx, "binding lifetime discovery")
+		}
+		return false, err
+	}
+
+	var mappedAddr stun.XORMappedAddress
+	if err = mappedAddr.GetFrom(trRes.msg); err != nil {
+		return false, errNoXORMappedAddress
+	}
+
+	select {
+	case <-nats.clock.After(idle):
+	case <-ctx.Done():
+		return false, contextError(ctx, "binding lifetime discovery")
+	}
+
+	// Have the server respond to the mapped port of X
+	msg, err = stun.Build(stun.TransactionID, stun.BindingRequest,
+		&attr.ResponsePort{Port: mappedAddr.Port}, responsePortPadding)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = nats.roundTripVia(ctx, connY, connX, msg, nats.serverAddr, "binding lifetime discovery")
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, contextError(ctx, "binding lifetime discovery")
+		}
+		// Only the lack of a response tells that the binding expired
+		if errors.Is(err, errNoResponse) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,176 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock lets time pass instantly when waited for.
+type fakeClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// failingConn fails every write.
+type failingConn struct {
+	net.PacketConn
+}
+
+func (c *failingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+// Has the WAN drop inbound packets to NAT bindings that have been idle for
+// longer than lifetime, as measured by the clock.
+func expireBindings(v *virtualNet, clock Clock, lifetime time.Duration) {
+	natIP := net.ParseIP("27.1.1.1")
+	lastOutbound := map[string]time.Time{}
+	var mutex sync.Mutex
+
+	v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		src := c.SourceAddr().(*net.UDPAddr)
+		if src.IP.Equal(natIP) {
+			lastOutbound[src.String()] = clock.Now()
+			return true
+		}
+
+		dst := c.DestinationAddr().(*net.UDPAddr)
+		if dst.IP.Equal(natIP) {
+			last, ok := lastOutbound[dst.String()]
+			if !ok || clock.Now().Sub(last) > lifetime {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestDiscoverBindingLifetime(t *testing.T) {
+	testCases := []struct {
+		name     string
+		lifetime time.Duration
+		lower    time.Duration
+		upper    time.Duration
+	}{
+		{"30 seconds", 30 * time.Second, 29 * time.Second, 31 * time.Second},
+		{"Longer than max", 10 * time.Minute, 2 * time.Minute, 0},
+		{"Shorter than min", 500 * time.Millisecond, 0, time.Second},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := buildVNet(&vnet.NATType{
+				MappingBehavior:   vnet.EndpointIndependent,
+				FilteringBehavior: vnet.EndpointAddrPortDependent,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+
+			clock := &fakeClock{now: time.Now()}
+			expireBindings(v, clock, tc.lifetime)
+
+			nats, err := NewNATS(&Config{
+				Server:             "stun.pion.net:3478",
+				Net:                v.net0,
+				TransactionTimeout: 200 * time.Millisecond,
+				Clock:              clock,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			res, err := nats.DiscoverBindingLifetime(context.Background())
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			log := v.loggerFactory.NewLogger("test")
+			log.Debugf("%+v", res)
+
+			assert.True(t, res.Lifetime >= tc.lower, "lifetime should not be underestimated")
+			assert.True(t, res.Lifetime <= tc.lifetime, "lifetime should not be overestimated")
+			if tc.upper > 0 {
+				assert.True(t, res.UpperBound > tc.lifetime, "upper bound should be above the lifetime")
+				assert.True(t, res.UpperBound <= tc.upper, "upper bound should be tight")
+				assert.True(t, res.UpperBound-res.Lifetime <= time.Second, "should be within resolution")
+			} else {
+				assert.Equal(t, time.Duration(0), res.UpperBound, "should be unbounded")
+			}
+		})
+	}
+
+	t.Run("Error other than no response", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 200 * time.Millisecond,
+			Clock:              &fakeClock{now: time.Now()},
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		connX, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer connX.Close() // nolint:errcheck,gosec
+		connY, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer connY.Close() // nolint:errcheck,gosec
+
+		// Not to be taken for an expired binding
+		alive, err := nats.probeBinding(context.Background(), connX, &failingConn{connY}, time.Second)
+		assert.Error(t, err, "should fail")
+		assert.False(t, alive, "should not be alive")
+	})
+
+	t.Run("Invalid bounds", func(t *testing.T) {
+		_, err := NewNATS(&Config{
+			Server:             "1.2.3.4:3478",
+			Net:                vnet.NewNet(&vnet.NetConfig{}),
+			BindingLifetimeMin: time.Minute,
+			BindingLifetimeMax: time.Second,
+		})
+		assert.Error(t, err, "should fail")
+	})
+}
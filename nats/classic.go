@@ -0,0 +1,196 @@
+package nats
+
+import (
+	"context"
+	"net"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/stun"
+)
+
+// Performs the classic NAT type discovery defined in RFC 3489 Section 10.1.
+//
+// Unlike RFC 5780, the mapping behavior is only told to be endpoint
+// independent or not, so it is left undefined for a symmetric NAT. The
+// filtering behavior is left undefined where the tests could not tell it,
+// which includes the case the server ignored CHANGE-REQUEST.
+func (nats *NATS) discoverClassic(ctx context.Context) (*DiscoverResult, error) {
+	// Not reused, as Test I toward the alternate address opens the filter
+	// of the mapping to it.
+	sc, err := nats.newSTUNClient()
+	if err != nil {
+		return nil, err
+	}
+	defer sc.close()
+
+	locAddr := sc.conn.LocalAddr().(*net.UDPAddr)
+
+	res := &DiscoverResult{
+		Network:           nats.network,
+		Algorithm:         AlgorithmRFC3489,
+		MappingBehavior:   EndpointUndefined,
+		FilteringBehavior: EndpointUndefined,
+	}
+
+	// Test I
+	trRes, err := nats.classicTest(ctx, sc, nats.serverAddr, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, contextError(ctx, "classic discovery")
+		}
+		nats.log.Debugf("Test I failed: %s", err.Error())
+		res.NATType = NATTypeUDPBlocked
+		return res, nil
+	}
+
+	mappedAddr, err := getMappedAddress(trRes.msg)
+	if err != nil {
+		return nil, nats.probeError("classic discovery", 0, nats.serverAddr, err)
+	}
+	nats.log.Debugf("MAPPED-ADDRESS (Test I): %s", mappedAddr.String())
+
+	res.IsNatted = !nats.findIsLocalIP(mappedAddr.IP)
+	res.PortPreservation = (mappedAddr.Port == locAddr.Port)
+	res.ExternalIP = mappedAddr.IP.String()
+
+	altAddr, attrName, altErr := getOtherAddress(trRes.msg)
+	if altErr == nil {
+		res.AlternateAddressAttr = attrName
+	}
+
+	// Test II: change IP and port
+	received, honored, err := nats.classicChangeTest(ctx, sc, true, true)
+	if err != nil {
+		return nil, err
+	}
+	nats.log.Debugf("Test II: received=%v honored=%v", received, honored)
+
+	if !res.IsNatted {
+		res.MappingBehavior = EndpointIndependent
+		switch {
+		case !honored:
+			res.NATType = NATTypeNotNatted
+		case received:
+			res.FilteringBehavior = EndpointIndependent
+			res.NATType = NATTypeOpenInternet
+		default:
+			res.NATType = NATTypeSymmetricUDPFirewall
+		}
+		return res, nil
+	}
+
+	if received && honored {
+		res.MappingBehavior = EndpointIndependent
+		res.FilteringBehavior = EndpointIndependent
+		res.NATType = NATTypeFullCone
+		return res, nil
+	}
+
+	if altErr != nil {
+		res.NATType = NATTypeUndefined
+		return res, nil
+	}
+
+	// Test I again, toward the alternate address (the third probe)
+	altUDPAddr := &net.UDPAddr{IP: altAddr.IP, Port: altAddr.Port}
+	trRes, err = nats.classicTest(ctx, sc, altUDPAddr, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, contextError(ctx, "classic discovery")
+		}
+		return nil, nats.probeError("classic discovery", 2, altUDPAddr, err)
+	}
+
+	mappedAddr2, err := getMappedAddress(trRes.msg)
+	if err != nil {
+		return nil, nats.probeError("classic discovery", 2, altUDPAddr, err)
+	}
+	nats.log.Debugf("MAPPED-ADDRESS (Test I to %s): %s", altAddr.String(), mappedAddr2.String())
+
+	if !mappedAddr2.IP.Equal(mappedAddr.IP) || mappedAddr2.Port != mappedAddr.Port {
+		res.NATType = NATTypeSymmetric
+		return res, nil
+	}
+
+	res.MappingBehavior = EndpointIndependent
+
+	if !honored {
+		res.NATType = NATTypeCone
+		return res, nil
+	}
+
+	// Test III: change port
+	received, _, err = nats.classicChangeTest(ctx, sc, false, true)
+	if err != nil {
+		return nil, err
+	}
+	nats.log.Debugf("Test III: received=%v", received)
+
+	if received {
+		res.FilteringBehavior = EndpointAddrDependent
+		res.NATType = NATTypeAddrRestrictedCone
+	} else {
+		res.FilteringBehavior = EndpointAddrPortDependent
+		res.NATType = NATTypePortRestrictedCone
+	}
+
+	return res, nil
+}
+
+// Sends a Binding request with the given CHANGE-REQUEST, if any.
+func (nats *NATS) classicTest(ctx context.Context, sc *stunClient, to net.Addr, changeReq *attr.ChangeRequest) (*transactionResult, error) {
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if changeReq != nil {
+		if err = changeReq.AddTo(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	return nats.performTransaction(ctx, sc, msg, to, "classic discovery")
+}
+
+// Runs Test II or III. Tells whether the response was received and whether
+// it came from the address requested, that is, whether the server honored
+// CHANGE-REQUEST. An error is returned only when ctx is done.
+func (nats *NATS) classicChangeTest(ctx context.Context, sc *stunClient, changeIP, changePort bool) (bool, bool, error) {
+	trRes, err := nats.classicTest(ctx, sc, nats.serverAddr, &attr.ChangeRequest{
+		ChangeIP:   changeIP,
+		ChangePort: changePort,
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, false, contextError(ctx, "classic discovery")
+		}
+		return false, true, nil
+	}
+
+	from := trRes.from.(*net.UDPAddr)
+	if changeIP && from.IP.Equal(nats.serverAddr.IP) {
+		return true, false, nil
+	}
+	if changePort && from.Port == nats.serverAddr.Port {
+		return true, false, nil
+	}
+
+	return true, true, nil
+}
+
+// Reads the mapped address from a Binding response. XOR-MAPPED-ADDRESS is
+// preferred over MAPPED-ADDRESS, which RFC 3489 servers send instead.
+func getMappedAddress(m *stun.Message) (*net.UDPAddr, error) {
+	var xorAddr stun.XORMappedAddress
+	if err := xorAddr.GetFrom(m); err == nil {
+		return &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}, nil
+	}
+
+	var addr attr.Address
+	if err := addr.GetAs(m, attr.TypeMappedAddress); err == nil {
+		return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+	}
+
+	return nil, errNoXORMappedAddress
+}
@@ -0,0 +1,181 @@
+package nats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/enobufs/go-nats/server"
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverClassic(t *testing.T) {
+	testCases := []struct {
+		name      string
+		natType   *vnet.NATType
+		mapping   EndpointDependencyType
+		filtering EndpointDependencyType
+		expected  NATType
+	}{
+		{
+			name: "Full cone NAT",
+			natType: &vnet.NATType{
+				MappingBehavior:   vnet.EndpointIndependent,
+				FilteringBehavior: vnet.EndpointIndependent,
+			},
+			mapping:   EndpointIndependent,
+			filtering: EndpointIndependent,
+			expected:  NATTypeFullCone,
+		},
+		{
+			name: "Address-restricted cone NAT",
+			natType: &vnet.NATType{
+				MappingBehavior:   vnet.EndpointIndependent,
+				FilteringBehavior: vnet.EndpointAddrDependent,
+			},
+			mapping:   EndpointIndependent,
+			filtering: EndpointAddrDependent,
+			expected:  NATTypeAddrRestrictedCone,
+		},
+		{
+			name: "Port-restricted cone NAT",
+			natType: &vnet.NATType{
+				MappingBehavior:   vnet.EndpointIndependent,
+				FilteringBehavior: vnet.EndpointAddrPortDependent,
+			},
+			mapping:   EndpointIndependent,
+			filtering: EndpointAddrPortDependent,
+			expected:  NATTypePortRestrictedCone,
+		},
+		{
+			name: "Symmetric NAT",
+			natType: &vnet.NATType{
+				MappingBehavior:   vnet.EndpointAddrPortDependent,
+				FilteringBehavior: vnet.EndpointAddrPortDependent,
+			},
+			mapping:   EndpointUndefined,
+			filtering: EndpointUndefined,
+			expected:  NATTypeSymmetric,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := buildVNetWithServer(tc.natType, func(config *server.Config) {
+				config.LegacyMappedAddress = true
+				config.AlternateAddressAttrs = []stun.AttrType{server.AttrTypeChangedAddress}
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+
+			nats, err := NewNATS(&Config{
+				Server:             "stun.pion.net:3478",
+				Net:                v.net0,
+				TransactionTimeout: 300 * time.Millisecond,
+				Algorithm:          AlgorithmRFC3489,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			res, err := nats.Discover()
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			assert.Equal(t, AlgorithmRFC3489, res.Algorithm, "should match")
+			assert.True(t, res.IsNatted, "should be natted")
+			assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
+			assert.Equal(t, tc.mapping, res.MappingBehavior, "should match")
+			assert.Equal(t, tc.filtering, res.FilteringBehavior, "should match")
+			assert.Equal(t, tc.expected, res.NATType, "should match")
+		})
+	}
+}
+
+func TestDiscoverAuto(t *testing.T) {
+	natType := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointAddrDependent,
+	}
+
+	t.Run("CHANGE-REQUEST honored", func(t *testing.T) {
+		v, err := buildVNet(natType)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:    "stun.pion.net:3478",
+			Net:       v.net0,
+			Algorithm: AlgorithmAuto,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		res, err := nats.Discover()
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.Equal(t, AlgorithmRFC5780, res.Algorithm, "should match")
+		assert.Equal(t, NATTypeAddrRestrictedCone, res.NATType, "should match")
+	})
+
+	t.Run("CHANGE-REQUEST ignored", func(t *testing.T) {
+		v, err := buildVNetWithServer(natType, func(config *server.Config) {
+			config.IgnoreChangeRequest = true
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 300 * time.Millisecond,
+			Algorithm:          AlgorithmAuto,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		res, err := nats.Discover()
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.Equal(t, AlgorithmRFC3489, res.Algorithm, "should match")
+		assert.Equal(t, EndpointIndependent, res.MappingBehavior, "should match")
+		assert.Equal(t, EndpointUndefined, res.FilteringBehavior, "should match")
+		assert.Equal(t, NATTypeCone, res.NATType, "should match")
+
+		// Without the fallback, the discovery fails.
+		nats, err = NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 300 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		_, err = nats.Discover()
+		assert.Error(t, err, "should fail")
+	})
+
+	t.Run("Unsupported algorithm", func(t *testing.T) {
+		_, err := NewNATS(&Config{
+			Server:    "stun.pion.net:3478",
+			Algorithm: "rfc1234",
+		})
+		assert.Error(t, err, "should fail")
+	})
+}
@@ -0,0 +1,207 @@
+package nats
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConnectivityStrategy is the way two peers are expected to reach each other
+// over UDP.
+type ConnectivityStrategy uint8
+
+const (
+	// StrategyDirect means one of the peers accepts packets from anyone at its
+	// external address, so the other can just send to it
+	StrategyDirect ConnectivityStrategy = iota
+	// StrategyHolePunching means both peers send to the external address of
+	// each other at the same time, each opening its NAT for the other
+	StrategyHolePunching
+	// StrategyPortPrediction means hole punching where the external port of
+	// a peer behind a symmetric NAT must be predicted from its port allocation
+	StrategyPortPrediction
+	// StrategyRelay means the peers can only reach each other through a relay,
+	// such as a TURN server
+	StrategyRelay
+)
+
+var strategyTexts = [...]string{
+	StrategyDirect:         "direct",
+	StrategyHolePunching:   "hole-punching",
+	StrategyPortPrediction: "port-prediction",
+	StrategyRelay:          "relay",
+}
+
+func (s ConnectivityStrategy) String() string {
+	return enumString(strategyTexts[:], uint8(s))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s ConnectivityStrategy) MarshalText() ([]byte, error) {
+	return marshalEnum(strategyTexts[:], uint8(s), "connectivity strategy")
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *ConnectivityStrategy) UnmarshalText(text []byte) error {
+	return unmarshalEnum(strategyTexts[:], text, (*uint8)(s), "connectivity strategy")
+}
+
+// Connectivity contains the result of PredictConnectivity. The peers are
+// referred to as "a" and "b", in the order given.
+type Connectivity struct {
+	Strategy ConnectivityStrategy `json:"strategy"`
+	// Peer that sends first. (StrategyDirect only)
+	Initiator string `json:"initiator,omitempty"`
+	// Peers whose external port toward the other must be predicted, from
+	// DiscoverResult.PortAllocation. (StrategyPortPrediction only)
+	Predicted []string `json:"predicted,omitempty"`
+	// Why the strategy was chosen
+	Rationale string `json:"rationale"`
+}
+
+type peer struct {
+	name string
+	res  *DiscoverResult
+}
+
+// Tells if the peer keeps the same external address toward any endpoint.
+func (p peer) stableMapping() bool {
+	return !p.res.IsNatted || p.res.MappingBehavior == EndpointIndependent
+}
+
+// Tells if packets from anyone reach the peer at its external address.
+func (p peer) acceptsAnyone() bool {
+	return p.stableMapping() && p.res.FilteringBehavior == EndpointIndependent
+}
+
+// Tells if the external port of a new mapping can be predicted. Ports
+// allocated randomly, or not analyzed at all, cannot.
+func (p peer) predictable() bool {
+	pa := p.res.PortAllocation
+	return pa != nil && (pa.Pattern == PortAllocationPreserved || pa.Pattern == PortAllocationSequential)
+}
+
+// PredictConnectivity tells how two peers, given the results of their
+// discoveries, can reach each other over UDP, by the matrix of the mapping
+// and filtering behaviors of RFC 4787:
+//   - If either peer has endpoint-independent mapping and filtering (full cone
+//     or open to the Internet), the other sends to it directly.
+//   - If both have endpoint-independent mapping, they punch holes toward the
+//     external address of each other.
+//   - If only one of them has endpoint-independent mapping, the peer with the
+//     symmetric NAT can punch a hole if the other filters by address only, or
+//     else only if its port allocation can be predicted.
+//   - If both have symmetric NATs, both ports must be predicted.
+//
+// Undefined filtering behaviors are taken as address and port-dependent. Peers
+// behind the same NAT (the same external IP) can only reach each other over
+// their external addresses if the NAT hairpins. For the port allocation to be
+// known, the discoveries must have run with Config.PortAllocationProbes.
+func PredictConnectivity(a, b *DiscoverResult) *Connectivity {
+	peers := [2]peer{{"a", a}, {"b", b}}
+
+	for _, p := range peers {
+		if p.res.NATType == NATTypeUDPBlocked {
+			return &Connectivity{
+				Strategy:  StrategyRelay,
+				Rationale: fmt.Sprintf("UDP is blocked for %s", p.name),
+			}
+		}
+	}
+
+	if strings.HasSuffix(a.Network, "6") != strings.HasSuffix(b.Network, "6") {
+		return &Connectivity{
+			Strategy: StrategyRelay,
+			Rationale: fmt.Sprintf("a is on %s and b on %s, and only a relay can translate between them",
+				a.Network, b.Network),
+		}
+	}
+
+	var note string
+	if a.IsNatted && b.IsNatted && a.ExternalIP == b.ExternalIP {
+		if !a.Hairpinning || !b.Hairpinning {
+			return &Connectivity{
+				Strategy: StrategyRelay,
+				Rationale: fmt.Sprintf("a and b are behind the same NAT at %s, which does not hairpin; "+
+					"unless their local addresses reach each other, a relay is needed", a.ExternalIP),
+			}
+		}
+		note = fmt.Sprintf("; they are behind the same NAT at %s, which hairpins", a.ExternalIP)
+	}
+
+	conn := predictConnectivity(peers)
+	conn.Rationale += note
+	return conn
+}
+
+func predictConnectivity(peers [2]peer) *Connectivity {
+	for i, p := range peers {
+		if p.acceptsAnyone() {
+			other := peers[1-i]
+			return &Connectivity{
+				Strategy:  StrategyDirect,
+				Initiator: other.name,
+				Rationale: fmt.Sprintf("%s accepts packets from anyone at %s (%s), so %s sends to it first",
+					p.name, p.res.ExternalIP, p.res.NATType, other.name),
+			}
+		}
+	}
+
+	a, b := peers[0], peers[1]
+	if a.stableMapping() && b.stableMapping() {
+		return &Connectivity{
+			Strategy: StrategyHolePunching,
+			Rationale: fmt.Sprintf("both keep the same external address toward any endpoint (a: %s, b: %s), "+
+				"so each opens its own filter by sending to the other", a.res.NATType, b.res.NATType),
+		}
+	}
+
+	if a.stableMapping() || b.stableMapping() {
+		stable, symmetric := a, b
+		if !a.stableMapping() {
+			stable, symmetric = b, a
+		}
+
+		if stable.res.FilteringBehavior == EndpointAddrDependent {
+			return &Connectivity{
+				Strategy: StrategyHolePunching,
+				Rationale: fmt.Sprintf("%s filters by address only, so packets from the unknown external port "+
+					"of %s (%s) pass once %s has sent to its address", stable.name, symmetric.name,
+					symmetric.res.NATType, stable.name),
+			}
+		}
+
+		if symmetric.predictable() {
+			return &Connectivity{
+				Strategy:  StrategyPortPrediction,
+				Predicted: []string{symmetric.name},
+				Rationale: fmt.Sprintf("%s filters by address and port, so %s must send to the external port "+
+					"of %s (%s) predicted from its %s port allocation", stable.name, stable.name,
+					symmetric.name, symmetric.res.NATType, symmetric.res.PortAllocation.Pattern),
+			}
+		}
+
+		return &Connectivity{
+			Strategy: StrategyRelay,
+			Rationale: fmt.Sprintf("%s filters by address and port, and the external port of %s (%s) "+
+				"cannot be predicted", stable.name, symmetric.name, symmetric.res.NATType),
+		}
+	}
+
+	for _, p := range peers {
+		if !p.predictable() {
+			return &Connectivity{
+				Strategy: StrategyRelay,
+				Rationale: fmt.Sprintf("both are behind symmetric NATs, and the external port of %s "+
+					"cannot be predicted", p.name),
+			}
+		}
+	}
+
+	return &Connectivity{
+		Strategy:  StrategyPortPrediction,
+		Predicted: []string{a.name, b.name},
+		Rationale: fmt.Sprintf("both are behind symmetric NATs, and must send to the external port of each "+
+			"other predicted from their port allocations (a: %s, b: %s)",
+			a.res.PortAllocation.Pattern, b.res.PortAllocation.Pattern),
+	}
+}
@@ -0,0 +1,388 @@
+package nats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPeer struct {
+	net *vnet.Net
+	res *DiscoverResult
+}
+
+// Sends a Binding request to the STUN server from conn and returns the mapped
+// address.
+func bind(conn net.PacketConn) (*net.UDPAddr, error) {
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	_, err := conn.WriteTo(req.Raw, &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 3478})
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{}) // nolint:errcheck,gosec
+
+	buf := make([]byte, 1500)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &stun.Message{Raw: buf[:n]}
+	if err = res.Decode(); err != nil {
+		return nil, err
+	}
+
+	var addr stun.XORMappedAddress
+	if err = addr.GetFrom(res); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+}
+
+// Tries to get packets across between the two peers the way conn tells: both
+// send to the external address of the other, with the port predicted for the
+// peers in conn.Predicted, and answer whatever they receive. With
+// StrategyDirect, only the initiator sends first. Returns true if both
+// received something.
+func tryConnect(t *testing.T, a, b *testPeer, conn *Connectivity) bool {
+	peers := map[string]*testPeer{"a": a, "b": b}
+	conns := map[string]net.PacketConn{}
+	targets := map[string]*net.UDPAddr{} // toward the peer
+	for name, p := range peers {
+		c, err := p.net.ListenPacket("udp4", "0.0.0.0:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return false
+		}
+		defer c.Close() // nolint:errcheck,gosec
+
+		mapped, err := bind(c)
+		if !assert.NoError(t, err, "should succeed") {
+			return false
+		}
+
+		for _, predicted := range conn.Predicted {
+			if predicted != name {
+				continue
+			}
+			pa := p.res.PortAllocation
+			if pa.Pattern == PortAllocationPreserved {
+				mapped.Port = c.LocalAddr().(*net.UDPAddr).Port
+			} else {
+				mapped.Port += pa.Delta
+			}
+		}
+
+		conns[name] = c
+		targets[name] = mapped
+	}
+
+	var wg sync.WaitGroup
+	received := map[string]bool{}
+	var mutex sync.Mutex
+	for name := range peers {
+		name, other := name, "b"
+		if name == "b" {
+			other = "a"
+		}
+		c := conns[name]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 64)
+			c.SetReadDeadline(time.Now().Add(time.Second)) // nolint:errcheck,gosec
+			for {
+				n, from, err := c.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				mutex.Lock()
+				received[name] = true
+				mutex.Unlock()
+				if string(buf[:n]) == "ping" {
+					c.WriteTo([]byte("pong"), from) // nolint:errcheck,gosec
+				}
+			}
+		}()
+
+		if conn.Strategy == StrategyDirect && conn.Initiator != name {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				c.WriteTo([]byte("ping"), targets[other]) // nolint:errcheck,gosec
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return received["a"] && received["b"]
+}
+
+func TestPredictConnectivityOnVNet(t *testing.T) {
+	natTypes := []struct {
+		name    string
+		natType *vnet.NATType
+		probes  int
+	}{
+		{"open", nil, 0},
+		{"full cone", &vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		}, 0},
+		{"address-restricted", &vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointAddrDependent,
+		}, 0},
+		{"port-restricted", &vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		}, 0},
+		{"symmetric", &vnet.NATType{
+			MappingBehavior:   vnet.EndpointAddrPortDependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		}, 3},
+		{"symmetric, unknown allocation", &vnet.NATType{
+			MappingBehavior:   vnet.EndpointAddrPortDependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		}, 0},
+	}
+
+	testCases := []struct {
+		a, b     string
+		expected ConnectivityStrategy
+	}{
+		{"open", "open", StrategyDirect},
+		{"open", "full cone", StrategyDirect},
+		{"open", "address-restricted", StrategyDirect},
+		{"open", "port-restricted", StrategyDirect},
+		{"open", "symmetric", StrategyDirect},
+		{"open", "symmetric, unknown allocation", StrategyDirect},
+		{"full cone", "full cone", StrategyDirect},
+		{"full cone", "address-restricted", StrategyDirect},
+		{"full cone", "port-restricted", StrategyDirect},
+		{"full cone", "symmetric", StrategyDirect},
+		{"full cone", "symmetric, unknown allocation", StrategyDirect},
+		{"address-restricted", "address-restricted", StrategyHolePunching},
+		{"address-restricted", "port-restricted", StrategyHolePunching},
+		{"address-restricted", "symmetric", StrategyHolePunching},
+		{"address-restricted", "symmetric, unknown allocation", StrategyHolePunching},
+		{"port-restricted", "port-restricted", StrategyHolePunching},
+		{"port-restricted", "symmetric", StrategyPortPrediction},
+		{"port-restricted", "symmetric, unknown allocation", StrategyRelay},
+		{"symmetric", "symmetric", StrategyPortPrediction},
+		{"symmetric", "symmetric, unknown allocation", StrategyRelay},
+		{"symmetric, unknown allocation", "symmetric, unknown allocation", StrategyRelay},
+	}
+
+	v, err := buildVNet(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	// Two peers of each type, behind different NATs
+	peers := map[string][2]*testPeer{}
+	for i, nt := range natTypes {
+		var pair [2]*testPeer
+		for j := range pair {
+			n, err := v.addLAN(fmt.Sprintf("%d.1.1.%d", 30+j, i+1), fmt.Sprintf("10.%d.%d.0/24", j, i), nt.natType)
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			pair[j] = &testPeer{net: n}
+		}
+		peers[nt.name] = pair
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(natTypes))
+	for _, nt := range natTypes {
+		for _, p := range peers[nt.name] {
+			nt, p := nt, p
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				nats, err := NewNATS(&Config{
+					Server:               "stun.pion.net:3478",
+					Net:                  p.net,
+					TransactionTimeout:   500 * time.Millisecond,
+					PortAllocationProbes: nt.probes,
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer nats.Close() // nolint:errcheck,gosec
+
+				p.res, err = nats.Discover()
+				if err != nil {
+					errs <- fmt.Errorf("%s: %w", nt.name, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err, "should succeed")
+	}
+	if t.Failed() {
+		return
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.a+" to "+tc.b, func(t *testing.T) {
+			a, b := peers[tc.a][0], peers[tc.b][1]
+			conn := PredictConnectivity(a.res, b.res)
+			t.Logf("%s: %s", conn.Strategy, conn.Rationale)
+			assert.Equal(t, tc.expected, conn.Strategy, "should match")
+
+			// The other way around
+			reversed := PredictConnectivity(b.res, a.res)
+			assert.Equal(t, tc.expected, reversed.Strategy, "should match")
+
+			if tc.expected == StrategyRelay {
+				assert.False(t, tryConnect(t, a, b, conn), "should not get through without a relay")
+			} else {
+				assert.True(t, tryConnect(t, a, b, conn), "should get through")
+			}
+		})
+	}
+
+	t.Run("Behind the same NAT", func(t *testing.T) {
+		var results [2]*DiscoverResult
+		for i := range results {
+			nats, err := NewNATS(&Config{
+				Server:             "stun.pion.net:3478",
+				Net:                v.net0,
+				TransactionTimeout: 500 * time.Millisecond,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			results[i], err = nats.Discover()
+			nats.Close() // nolint:errcheck,gosec
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+		}
+
+		// vnet does not hairpin
+		assert.False(t, results[0].Hairpinning, "should not hairpin")
+		conn := PredictConnectivity(results[0], results[1])
+		assert.Equal(t, StrategyRelay, conn.Strategy, "should match")
+		assert.Contains(t, conn.Rationale, "same NAT", "should tell why")
+	})
+}
+
+func TestPredictConnectivity(t *testing.T) {
+	fullCone := &DiscoverResult{
+		IsNatted:          true,
+		MappingBehavior:   EndpointIndependent,
+		FilteringBehavior: EndpointIndependent,
+		NATType:           NATTypeFullCone,
+		ExternalIP:        "27.1.1.1",
+		Network:           "udp4",
+	}
+	portRestricted := &DiscoverResult{
+		IsNatted:          true,
+		MappingBehavior:   EndpointIndependent,
+		FilteringBehavior: EndpointAddrPortDependent,
+		NATType:           NATTypePortRestrictedCone,
+		ExternalIP:        "28.1.1.1",
+		Network:           "udp4",
+	}
+	symmetric := func(pattern PortAllocationPattern) *DiscoverResult {
+		return &DiscoverResult{
+			IsNatted:          true,
+			MappingBehavior:   EndpointAddrPortDependent,
+			FilteringBehavior: EndpointAddrPortDependent,
+			NATType:           NATTypeSymmetric,
+			ExternalIP:        "29.1.1.1",
+			Network:           "udp4",
+			PortAllocation:    &PortAllocation{Pattern: pattern},
+		}
+	}
+
+	t.Run("Direct", func(t *testing.T) {
+		conn := PredictConnectivity(portRestricted, fullCone)
+		assert.Equal(t, StrategyDirect, conn.Strategy, "should match")
+		assert.Equal(t, "a", conn.Initiator, "should match")
+	})
+
+	t.Run("Port allocation", func(t *testing.T) {
+		conn := PredictConnectivity(portRestricted, symmetric(PortAllocationPreserved))
+		assert.Equal(t, StrategyPortPrediction, conn.Strategy, "should match")
+		assert.Equal(t, []string{"b"}, conn.Predicted, "should match")
+
+		conn = PredictConnectivity(portRestricted, symmetric(PortAllocationRandom))
+		assert.Equal(t, StrategyRelay, conn.Strategy, "should match")
+
+		other := symmetric(PortAllocationPreserved)
+		other.ExternalIP = "30.1.1.1"
+		conn = PredictConnectivity(symmetric(PortAllocationSequential), other)
+		assert.Equal(t, StrategyPortPrediction, conn.Strategy, "should match")
+		assert.Equal(t, []string{"a", "b"}, conn.Predicted, "should match")
+	})
+
+	t.Run("Undefined filtering", func(t *testing.T) {
+		cone := *portRestricted
+		cone.FilteringBehavior = EndpointUndefined
+		cone.NATType = NATTypeCone
+		conn := PredictConnectivity(&cone, symmetric(PortAllocationRandom))
+		assert.Equal(t, StrategyRelay, conn.Strategy, "should be taken as port-restricted")
+	})
+
+	t.Run("Hairpinning", func(t *testing.T) {
+		a, b := *portRestricted, *portRestricted
+		conn := PredictConnectivity(&a, &b)
+		assert.Equal(t, StrategyRelay, conn.Strategy, "should match")
+
+		a.Hairpinning, b.Hairpinning = true, true
+		conn = PredictConnectivity(&a, &b)
+		assert.Equal(t, StrategyHolePunching, conn.Strategy, "should match")
+		assert.Contains(t, conn.Rationale, "hairpins", "should tell why")
+	})
+
+	t.Run("UDP blocked", func(t *testing.T) {
+		conn := PredictConnectivity(fullCone, &DiscoverResult{NATType: NATTypeUDPBlocked, Network: "udp4"})
+		assert.Equal(t, StrategyRelay, conn.Strategy, "should match")
+	})
+
+	t.Run("Different address families", func(t *testing.T) {
+		ipv6 := *fullCone
+		ipv6.Network = "udp6"
+		conn := PredictConnectivity(fullCone, &ipv6)
+		assert.Equal(t, StrategyRelay, conn.Strategy, "should match")
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		data, err := json.Marshal(PredictConnectivity(portRestricted, symmetric(PortAllocationSequential)))
+		assert.NoError(t, err, "should succeed")
+		var conn Connectivity
+		assert.NoError(t, json.Unmarshal(data, &conn), "should succeed")
+		assert.Equal(t, StrategyPortPrediction, conn.Strategy, "should match")
+		assert.Contains(t, string(data), `"strategy":"port-prediction"`, "should match")
+	})
+}
@@ -1,10 +1,16 @@
 package nats
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/enobufs/go-nats/internal/attr"
 	"github.com/pion/logging"
 	"github.com/pion/stun"
 	"github.com/pion/transport/vnet"
@@ -37,91 +43,414 @@ func (t EndpointDependencyType) String() string {
 	return "unspecified"
 }
 
+// TranslationType describes how the NAT, if any, translates the address.
+type TranslationType uint8
+
+const (
+	// TranslationNone means the address is not translated (native address)
+	TranslationNone TranslationType = iota
+	// TranslationNAT means the address is translated by a stateful NAT
+	// (NAT44 with udp4, NAT66 with udp6)
+	TranslationNAT
+	// TranslationNPTv6 means the IPv6 prefix is translated statelessly as
+	// defined in RFC 6296 (NPTv6)
+	TranslationNPTv6
+)
+
+func (t TranslationType) String() string {
+	switch t {
+	case TranslationNone:
+		return "none"
+	case TranslationNAT:
+		return "NAT"
+	case TranslationNPTv6:
+		return "NPTv6"
+	}
+	return "unspecified"
+}
+
 // DiscoverResult contains a set of results from Discover method.
 type DiscoverResult struct {
-	IsNatted          bool                   `json:"isNatted"`
-	MappingBehavior   EndpointDependencyType `json:"mappingBehavior"`
-	FilteringBehavior EndpointDependencyType `json:"filteringBehavior"`
-	PortPreservation  bool                   `json:"portPreservation"`
-	NATType           string                 `json:"natType"`
-	ExternalIP        string                 `json:"externalIP"`
+	SchemaVersion        int                    `json:"schemaVersion"`
+	IsNatted             bool                   `json:"isNatted"`
+	MappingBehavior      EndpointDependencyType `json:"mappingBehavior"`
+	FilteringBehavior    EndpointDependencyType `json:"filteringBehavior"`
+	PortPreservation     bool                   `json:"portPreservation"`
+	NATType              NATType                `json:"natType"`
+	ExternalIP           string                 `json:"externalIP"`
+	Network              string                 `json:"network,omitempty"`
+	Translation          TranslationType        `json:"translation"`
+	AlternateAddressAttr string                 `json:"alternateAddressAttr"` // "OTHER-ADDRESS" or "CHANGED-ADDRESS"
+	Hairpinning          bool                   `json:"hairpinning"`
+	Algorithm            string                 `json:"algorithm"`
+	PortAllocation       *PortAllocation        `json:"portAllocation,omitempty"`
+	// Set only when multiple servers are queried
+	Servers       []*ServerResult `json:"servers,omitempty"`
+	Confidence    float64         `json:"confidence,omitempty"`
+	Disagreements []string        `json:"disagreements,omitempty"`
+	// Set only with ProtocolTCP
+	TCP *TCPResult `json:"tcp,omitempty"`
+	// Set only with Config.Trace
+	Trace []*ProbeTrace `json:"trace,omitempty"`
 }
 
+// hairpinningTimeout bounds the wait for a hairpinned request when
+// Config.TransactionTimeout is unset. It never leaves the NAT, so waiting for
+// the whole retransmission schedule would only delay the result.
+const hairpinningTimeout = time.Second
+
+// Discovery algorithms
+const (
+	// AlgorithmRFC5780 tests the mapping and filtering behaviors separately,
+	// as defined in RFC 5780. The server must honor CHANGE-REQUEST.
+	AlgorithmRFC5780 = "rfc5780"
+	// AlgorithmRFC3489 follows the classic decision tree of RFC 3489, which
+	// also works with servers that only send MAPPED-ADDRESS. Filtering
+	// behavior is left undefined if the server ignores CHANGE-REQUEST.
+	AlgorithmRFC3489 = "rfc3489"
+	// AlgorithmAuto tries AlgorithmRFC5780 first, then falls back to
+	// AlgorithmRFC3489 if the server turns out not to support it.
+	AlgorithmAuto = "auto"
+)
+
 // Config has config parameters for NewNATS.
 type Config struct {
-	Server  string
+	Server string
+	// Servers, when given, replaces Server. With more than one server, they
+	// are all queried concurrently and the results are merged by majority.
+	Servers []string
+	// Verbose logs the details of discoveries at the debug level to stderr.
+	// Ignored if LoggerFactory is given.
 	Verbose bool
 	Net     *vnet.Net
+	// Network is either "udp4" (default) or "udp6". With "udp6", discovery runs
+	// over IPv6 and the filtering behavior found is that of the firewall in
+	// front of the host, whether or not the address is translated.
+	Network string
+	// Timeout limits the overall duration of a discovery. Zero means no limit
+	// other than the deadline of the context given to DiscoverContext.
+	Timeout time.Duration
+	// TransactionTimeout limits how long each STUN transaction waits for its
+	// response. Zero leaves it to the retransmission schedule of turn.Client,
+	// which gives up after about 8 seconds, except for the hairpinned request
+	// of the hairpinning discovery, which is waited for 1 second.
+	TransactionTimeout time.Duration
+	// Range and precision of the search by DiscoverBindingLifetime. Default to
+	// 1 second, 2 minutes and 1 second respectively.
+	BindingLifetimeMin        time.Duration
+	BindingLifetimeMax        time.Duration
+	BindingLifetimeResolution time.Duration
+	// Clock used to wait for idle periods. Defaults to the system clock.
+	Clock Clock
+	// Algorithm is either AlgorithmRFC5780 (default), AlgorithmRFC3489 or
+	// AlgorithmAuto.
+	Algorithm string
+	// Number of sockets to open for the port allocation analysis, each of
+	// which creates mappings toward the four addresses of the server. The
+	// analysis runs only if this is set and the mapping behavior is endpoint
+	// dependent.
+	PortAllocationProbes int
+	// Protocol is either ProtocolUDP (default) or ProtocolTCP. With
+	// ProtocolTCP, only the mapping behavior is discovered, over TCP, and
+	// reported in DiscoverResult.TCP. Requires the real network.
+	Protocol string
+	// Credentials, when set, are added to every request with
+	// MESSAGE-INTEGRITY, and responses without valid integrity are rejected.
+	Credentials *Credentials
+	// Trace records every request sent in DiscoverResult.Trace.
+	Trace bool
+	// LoggerFactory is used for the logs of this package, with the scope
+	// "nats", and of the STUN clients. Defaults to
+	// logging.NewDefaultLoggerFactory() writing to stderr.
+	LoggerFactory logging.LoggerFactory
+	// Observer, when set, is notified of the progress of discoveries.
+	Observer Observer
 }
 
-// NATS a class supports NAT type discovery feature.
+// NATS a class supports NAT type discovery feature. It is safe for concurrent
+// use, each call running its discovery on its own sockets.
 type NATS struct {
-	serverAddr net.Addr
-	verbose    bool
-	net        *vnet.Net
-	dfErr      error // filled by discoverFilteringBehavior
+	network                   string
+	server                    string   // host:port
+	servers                   []string // host:port, set only with more than one server
+	serverAddr                *net.UDPAddr
+	net                       *vnet.Net
+	timeout                   time.Duration
+	transactionTimeout        time.Duration
+	bindingLifetimeMin        time.Duration
+	bindingLifetimeMax        time.Duration
+	bindingLifetimeResolution time.Duration
+	clock                     Clock
+	portAllocationProbes      int
+	algorithm                 string
+	protocol                  string
+	auth                      *authenticator
+	trace                     bool
+	observer                  Observer
+	loggerFactory             logging.LoggerFactory
+	log                       logging.LeveledLogger
+	res                       *resources
+}
+
+// transactionResult holds the outcome of a STUN transaction.
+type transactionResult struct {
+	msg     *stun.Message
+	from    net.Addr
+	retries int
+}
+
+// filteringResult is the outcome of the filtering behavior discovery.
+type filteringResult struct {
+	behavior EndpointDependencyType
+	err      error
+}
+
+// hairpinningResult is the outcome of the hairpinning discovery.
+type hairpinningResult struct {
+	hairpinning bool
+	err         error
+}
+
+// changeRequestResult is the outcome of a request with CHANGE-REQUEST.
+type changeRequestResult struct {
+	received bool
+	err      error // set if the server ignored CHANGE-REQUEST
 }
 
 // NewNATS creats a new instance of NATS.
 func NewNATS(config *Config) (*NATS, error) {
 	server := formatHostPort(config.Server, 3478)
 
+	var servers []string
+	if len(config.Servers) > 0 {
+		for _, s := range config.Servers {
+			servers = append(servers, formatHostPort(s, 3478))
+		}
+		server = servers[0]
+		if len(servers) == 1 {
+			servers = nil
+		}
+	}
+
 	if config.Net == nil {
 		config.Net = vnet.NewNet(nil)
 	}
 
-	serverAddr, err := config.Net.ResolveUDPAddr("udp", server)
-	if err != nil {
-		return nil, err
+	network := config.Network
+	switch network {
+	case "":
+		network = "udp4"
+	case "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	algorithm := config.Algorithm
+	switch algorithm {
+	case "":
+		algorithm = AlgorithmRFC5780
+	case AlgorithmRFC5780, AlgorithmRFC3489, AlgorithmAuto:
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+
+	protocol := config.Protocol
+	switch protocol {
+	case "":
+		protocol = ProtocolUDP
+	case ProtocolUDP:
+	case ProtocolTCP:
+		if config.Net.IsVirtual() {
+			return nil, fmt.Errorf("TCP is not supported on a virtual network")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+
+	// With more than one server, each of them is resolved on discovery so
+	// that one bad server does not spoil the others.
+	var serverAddr *net.UDPAddr
+	if len(servers) == 0 {
+		var err error
+		serverAddr, err = config.Net.ResolveUDPAddr(network, server)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	blMin := config.BindingLifetimeMin
+	if blMin == 0 {
+		blMin = defaultBindingLifetimeMin
+	}
+	blMax := config.BindingLifetimeMax
+	if blMax == 0 {
+		blMax = defaultBindingLifetimeMax
+	}
+	if blMin >= blMax {
+		return nil, fmt.Errorf("BindingLifetimeMin must be less than BindingLifetimeMax")
+	}
+	blRes := config.BindingLifetimeResolution
+	if blRes == 0 {
+		blRes = defaultBindingLifetimeResolution
+	}
+
+	clock := config.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	loggerFactory := config.LoggerFactory
+	if loggerFactory == nil {
+		defaultFactory := logging.NewDefaultLoggerFactory()
+		defaultFactory.Writer = os.Stderr
+		if config.Verbose {
+			defaultFactory.ScopeLevels["nats"] = logging.LogLevelDebug
+		}
+		loggerFactory = defaultFactory
 	}
 
 	return &NATS{
-		serverAddr: serverAddr,
-		verbose:    config.Verbose,
-		net:        config.Net,
+		network:                   network,
+		server:                    server,
+		servers:                   servers,
+		serverAddr:                serverAddr,
+		net:                       config.Net,
+		timeout:                   config.Timeout,
+		transactionTimeout:        config.TransactionTimeout,
+		bindingLifetimeMin:        blMin,
+		bindingLifetimeMax:        blMax,
+		bindingLifetimeResolution: blRes,
+		clock:                     clock,
+		portAllocationProbes:      config.PortAllocationProbes,
+		algorithm:                 algorithm,
+		protocol:                  protocol,
+		auth:                      newAuthenticator(config.Credentials),
+		trace:                     config.Trace,
+		observer:                  config.Observer,
+		loggerFactory:             loggerFactory,
+		log:                       loggerFactory.NewLogger("nats"),
+		res:                       newResources(),
 	}, nil
 }
 
 // Discover performs NAT discovery process defined in RFC 5780.
 func (nats *NATS) Discover() (*DiscoverResult, error) {
-	nats.dfErr = nil
-	conn, err := nats.net.ListenPacket("udp4", "0.0.0.0:0")
+	return nats.DiscoverContext(context.Background())
+}
+
+// DiscoverContext is like Discover but aborts as soon as ctx is done. Sockets
+// and STUN clients are torn down before it returns. When the discovery runs
+// out of time, the returned error is a *TimeoutError. When a request to the
+// server fails otherwise, it is a *DiscoveryError.
+func (nats *NATS) DiscoverContext(ctx context.Context) (*DiscoverResult, error) {
+	ctx, cancel, err := nats.res.start(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	defer cancel()
 
-	locAddr := conn.LocalAddr().(*net.UDPAddr)
-	if nats.verbose {
-		log.Printf("Local port: %d", locAddr.Port)
+	if nats.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nats.timeout)
+		defer cancel()
 	}
 
-	c, err := turn.NewClient(&turn.ClientConfig{
-		STUNServerAddr: nats.serverAddr.String(),
-		Conn:           conn,
-		LoggerFactory:  logging.NewDefaultLoggerFactory(),
-		Net:            nats.net,
-	})
-	if err != nil {
-		return nil, err
+	if len(nats.servers) > 0 {
+		return nats.discoverFromServers(ctx)
 	}
 
-	err = c.Listen()
+	return nats.discover(ctx)
+}
+
+// Performs the discovery against nats.serverAddr, with the requests traced if
+// asked, and the observer notified of the outcome.
+func (nats *NATS) discover(ctx context.Context) (*DiscoverResult, error) {
+	var t *tracer
+	if nats.trace {
+		t = &tracer{}
+		ctx = withTracer(ctx, t)
+	}
+
+	res, err := nats.discoverWithAlgorithm(ctx)
 	if err != nil {
+		nats.phaseCompleted("discovery", err)
 		return nil, err
 	}
 
-	if nats.verbose {
-		log.Printf("STUN server: %s", c.STUNServerAddr().String())
+	switch {
+	case res.TCP != nil:
+		nats.phaseCompleted("TCP mapping behavior discovery", nil)
+	case res.Algorithm == AlgorithmRFC3489:
+		nats.phaseCompleted("classic discovery", nil)
+	}
+
+	res.SchemaVersion = SchemaVersion
+	if t != nil {
+		res.Trace = t.trace()
+	}
+	return res, nil
+}
+
+// Performs the discovery against nats.serverAddr with the algorithm selected.
+func (nats *NATS) discoverWithAlgorithm(ctx context.Context) (*DiscoverResult, error) {
+	if nats.protocol == ProtocolTCP {
+		return nats.discoverTCP(ctx)
+	}
+
+	switch nats.algorithm {
+	case AlgorithmRFC3489:
+		return nats.discoverClassic(ctx)
+	case AlgorithmAuto:
+		res, err := nats.discoverRFC5780(ctx)
+		if errors.Is(err, ErrNoRFC5780Support) || errors.Is(err, ErrMalformedResponse) {
+			nats.log.Debugf("falling back to RFC 3489: %s", err.Error())
+			return nats.discoverClassic(ctx)
+		}
+		return res, err
+	}
+
+	return nats.discoverRFC5780(ctx)
+}
+
+// Performs the discovery defined in RFC 5780. The phases are told as they
+// complete.
+func (nats *NATS) discoverRFC5780(ctx context.Context) (*DiscoverResult, error) {
+	// Also stops the filtering behavior discovery when returning early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The client of the last discovery is reused, as the mapping behavior
+	// is the same whatever the mapping had been used for. It is kept only
+	// after a success, where no transaction is left behind.
+	sc := nats.res.acquire(nats.network)
+	if sc == nil {
+		var err error
+		sc, err = nats.newSTUNClient()
+		if err != nil {
+			return nil, err
+		}
 	}
+	succeeded := false
+	defer func() {
+		if succeeded {
+			nats.res.release(nats.network, sc)
+		} else {
+			sc.close()
+		}
+	}()
 
-	toAddrs := [4]*net.UDPAddr{c.STUNServerAddr().(*net.UDPAddr), nil, nil, nil}
+	locAddr := sc.conn.LocalAddr().(*net.UDPAddr)
+	nats.log.Debugf("Local port: %d", locAddr.Port)
+	nats.log.Debugf("STUN server: %s", nats.serverAddr.String())
+
+	toAddrs := [4]*net.UDPAddr{nats.serverAddr, nil, nil, nil}
 	mappedAddrs := [4]*net.UDPAddr{nil, nil, nil, nil}
 
-	res := &DiscoverResult{}
+	res := &DiscoverResult{Network: nats.network, Algorithm: AlgorithmRFC5780}
 
 	// Run filtering behavior disocvery in parallel
-	filterDiscovDone, err := nats.discoverFilteringBehavior()
+	var filterRes filteringResult
+	filterDiscovDone, err := nats.discoverFilteringBehavior(ctx, &filterRes)
 	if err != nil {
 		return nil, err
 	}
@@ -140,38 +469,31 @@ func (nats *NATS) Discover() (*DiscoverResult, error) {
 			return nil, err
 		}
 
-		trRes, err := c.PerformTransaction(msg, to, false)
+		trRes, err := nats.performTransaction(ctx, sc, msg, to, "mapping behavior discovery")
 		if err != nil {
-			return nil, err
+			return nil, nats.probeError("mapping behavior discovery", i, to, err)
 		}
 
 		var maddr stun.XORMappedAddress
-		if err = maddr.GetFrom(trRes.Msg); err != nil {
-			if err != nil {
-				return nil, fmt.Errorf("XOR-MAPPED-ADDRESS not found")
-			}
+		if err = maddr.GetFrom(trRes.msg); err != nil {
+			return nil, nats.probeError("mapping behavior discovery", i, to, errNoXORMappedAddress)
 		}
 		mappedAddrs[i] = &net.UDPAddr{IP: maddr.IP, Port: maddr.Port}
 
-		if nats.verbose {
-			log.Printf("MAPPED-ADDRESS [%d]: %s", i, mappedAddrs[i].String())
-		}
+		nats.log.Debugf("MAPPED-ADDRESS [%d]: %s", i, mappedAddrs[i].String())
 
 		if i == 0 {
 			res.IsNatted = !nats.findIsLocalIP(mappedAddrs[0].IP)
 			res.PortPreservation = (mappedAddrs[0].Port == locAddr.Port)
 			res.ExternalIP = mappedAddrs[0].IP.String()
 
-			var caddr attrAddress
-			if err = caddr.getAs(trRes.Msg, attrTypeChangedAddress); err != nil {
-				if err != nil {
-					return nil, fmt.Errorf("CHANGED-ADDRESS not found")
-				}
+			caddr, attrName, err := getOtherAddress(trRes.msg)
+			if err != nil {
+				return nil, nats.probeError("mapping behavior discovery", i, to, err)
 			}
+			res.AlternateAddressAttr = attrName
 
-			if nats.verbose {
-				log.Printf("CHANGED-ADDRESS: %s", caddr.String())
-			}
+			nats.log.Debugf("%s: %s", attrName, caddr.String())
 
 			toAddrs[1] = &net.UDPAddr{IP: toAddrs[0].IP, Port: caddr.Port}
 			toAddrs[2] = &net.UDPAddr{IP: caddr.IP, Port: toAddrs[0].Port}
@@ -182,122 +504,344 @@ func (nats *NATS) Discover() (*DiscoverResult, error) {
 	}
 
 	if res.IsNatted {
-		if mappedAddrs[0].Port != mappedAddrs[2].Port {
-			if mappedAddrs[0].Port != mappedAddrs[1].Port {
-				res.MappingBehavior = EndpointAddrPortDependent
-			} else {
-				res.MappingBehavior = EndpointAddrDependent
-			}
+		res.MappingBehavior = findMappingBehavior([4]int{
+			mappedAddrs[0].Port,
+			mappedAddrs[1].Port,
+			mappedAddrs[2].Port,
+			mappedAddrs[3].Port,
+		})
+	}
+	nats.phaseCompleted("mapping behavior discovery", nil)
+
+	if res.MappingBehavior != EndpointIndependent && nats.portAllocationProbes > 0 {
+		res.PortAllocation, err = nats.discoverPortAllocation(ctx, toAddrs, nats.portAllocationProbes)
+		if err != nil {
+			return nil, err
+		}
+		nats.phaseCompleted("port allocation analysis", nil)
+	}
+
+	// Hairpinning only matters behind NAT
+	var hairpinRes hairpinningResult
+	var hairpinDiscovDone <-chan struct{}
+	if res.IsNatted {
+		hairpinDiscovDone, err = nats.discoverHairpinning(ctx, &hairpinRes)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	// Wait for filtering behavior disocvery to complete
-	res.FilteringBehavior = <-filterDiscovDone
-	if nats.dfErr != nil {
-		return nil, nats.dfErr
+	select {
+	case <-filterDiscovDone:
+	case <-ctx.Done():
+	}
+	if ctx.Err() != nil {
+		return nil, contextError(ctx, "filtering behavior discovery")
+	}
+	if filterRes.err != nil {
+		return nil, filterRes.err
+	}
+	res.FilteringBehavior = filterRes.behavior
+	nats.phaseCompleted("filtering behavior discovery", nil)
+
+	// Wait for hairpinning disocvery to complete
+	if hairpinDiscovDone != nil {
+		select {
+		case <-hairpinDiscovDone:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			return nil, contextError(ctx, "hairpinning discovery")
+		}
+		if hairpinRes.err != nil {
+			return nil, hairpinRes.err
+		}
+		res.Hairpinning = hairpinRes.hairpinning
+		nats.phaseCompleted("hairpinning discovery", nil)
 	}
 
-	// Determine the NAT type
 	if res.IsNatted {
+		res.Translation = nats.findTranslation(mappedAddrs[0], locAddr.Port, res.MappingBehavior)
+	}
+
+	// Determine the NAT type
+	if res.Translation == TranslationNPTv6 {
+		res.NATType = NATTypeNPTv6
+	} else if res.IsNatted {
 		if res.MappingBehavior == EndpointIndependent {
 			switch res.FilteringBehavior {
 			case EndpointIndependent:
-				res.NATType = "Full cone NAT"
+				res.NATType = NATTypeFullCone
 			case EndpointAddrDependent:
-				res.NATType = "Address-restricted cone NAT"
+				res.NATType = NATTypeAddrRestrictedCone
 			case EndpointAddrPortDependent:
-				res.NATType = "Port-restricted cone NAT"
+				res.NATType = NATTypePortRestrictedCone
 			default:
-				res.NATType = "(undefined)"
+				res.NATType = NATTypeUndefined
 			}
 		} else {
-			res.NATType = "Symmetric NAT"
+			res.NATType = NATTypeSymmetric
 		}
 	} else {
 		if res.FilteringBehavior == EndpointIndependent {
-			res.NATType = "Open to the Internet"
+			res.NATType = NATTypeOpenInternet
+		} else if nats.network == "udp6" {
+			res.NATType = NATTypeStatefulFirewall
 		} else {
-			res.NATType = "UDP blocked by firewall"
+			res.NATType = NATTypeUDPBlockedByFirewall
 		}
 	}
 
+	succeeded = true
 	return res, nil
 }
 
+// Tells the mapping behavior from the ports mapped toward the four addresses
+// of the server, in the order of primary, primary IP with alternate port,
+// alternate IP with primary port, and alternate.
+func findMappingBehavior(ports [4]int) EndpointDependencyType {
+	if ports[0] == ports[2] {
+		return EndpointIndependent
+	}
+	if ports[0] == ports[1] {
+		return EndpointAddrDependent
+	}
+	return EndpointAddrPortDependent
+}
+
 // Test if this IP is a local IP.
 func (nats *NATS) findIsLocalIP(ip net.IP) bool {
-	// If we can bind this IP, it is a valid local IP address.
-	conn, err := nats.net.ListenPacket("udp", fmt.Sprintf("%s:0", ip.String()))
+	for _, localIP := range nats.localIPs() {
+		if localIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns IP addresses assigned to the local interfaces.
+func (nats *NATS) localIPs() []net.IP {
+	var ips []net.IP
+	ifs, err := nats.net.Interfaces()
 	if err != nil {
+		return nil
+	}
+	for _, ifc := range ifs {
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			switch a := addr.(type) {
+			case *net.IPNet:
+				ips = append(ips, a.IP)
+			case *net.IPAddr:
+				ips = append(ips, a.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// Tells how the mapped address was translated from the local address. Only
+// called when the mapped IP is not a local IP.
+func (nats *NATS) findTranslation(mapped *net.UDPAddr, locPort int, mapping EndpointDependencyType) TranslationType {
+	if mapped.IP.To4() != nil {
+		return TranslationNAT
+	}
+
+	// NPTv6 only rewrites the prefix, leaving the port intact, and does so
+	// statelessly, hence the mapping is endpoint independent.
+	if mapped.Port != locPort || mapping != EndpointIndependent {
+		return TranslationNAT
+	}
+
+	// The checksum-neutral mapping of RFC 6296 keeps the one's complement sum
+	// of the address unchanged. Look for a local address that could have been
+	// translated into the mapped one.
+	for _, ip := range nats.localIPs() {
+		if ip.To4() != nil || !ip.IsGlobalUnicast() {
+			continue
+		}
+		if isNPTv6Pair(ip, mapped.IP) {
+			return TranslationNPTv6
+		}
+	}
+
+	return TranslationNAT
+}
+
+// Tests if the two IPv6 addresses may be the internal and external addresses
+// of a checksum-neutral NPTv6 translation. (RFC 6296 Section 3.1)
+func isNPTv6Pair(internal, external net.IP) bool {
+	in := internal.To16()
+	ex := external.To16()
+	if in == nil || ex == nil || in.Equal(ex) {
 		return false
 	}
-	conn.Close()
-	return true
+	return onesComplementSum(in) == onesComplementSum(ex)
 }
 
-func (nats *NATS) discoverFilteringBehavior() (<-chan EndpointDependencyType, error) {
-	conn, err := nats.net.ListenPacket("udp4", "0.0.0.0:0")
+// Computes the 16-bit one's complement sum of an IPv6 address, with 0xffff
+// folded into 0 as both stand for zero in one's complement arithmetic.
+func onesComplementSum(ip net.IP) uint16 {
+	var sum uint32
+	for i := 0; i < len(ip); i += 2 {
+		sum += uint32(ip[i])<<8 | uint32(ip[i+1])
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	if sum == 0xffff {
+		return 0
+	}
+	return uint16(sum)
+}
+
+// Opens a socket on the wildcard address of the network to use.
+func (nats *NATS) listenPacket() (net.PacketConn, error) {
+	if nats.network == "udp6" {
+		return nats.net.ListenPacket("udp6", "[::]:0")
+	}
+	return nats.net.ListenPacket("udp4", "0.0.0.0:0")
+}
+
+// Runs the filtering behavior discovery in the background. The result is
+// stored in res, along with an error if the server turned out to ignore
+// CHANGE-REQUEST, before the returned channel is closed.
+func (nats *NATS) discoverFilteringBehavior(ctx context.Context, res *filteringResult) (<-chan struct{}, error) {
+	sc, err := nats.newSTUNClient()
 	if err != nil {
 		return nil, err
 	}
 
-	if nats.verbose {
-		locAddr := conn.LocalAddr().(*net.UDPAddr)
-		log.Printf("Local port: %d (for filtering discovery)", locAddr.Port)
+	locAddr := sc.conn.LocalAddr().(*net.UDPAddr)
+	nats.log.Debugf("Local port: %d (for filtering discovery)", locAddr.Port)
+
+	return runInBackground(func() {
+		defer sc.close()
+		*res = nats.findFilteringBehavior(ctx, sc)
+	}), nil
+}
+
+// Tells the filtering behavior from two requests with CHANGE-REQUEST, asking
+// for another IP and another port respectively.
+func (nats *NATS) findFilteringBehavior(ctx context.Context, sc *stunClient) filteringResult {
+	received1Ch, err := nats.performTransactionWith(ctx, sc, true, false)
+	if err != nil {
+		return filteringResult{behavior: EndpointUndefined}
+	}
+	received2Ch, err := nats.performTransactionWith(ctx, sc, false, true)
+	if err != nil {
+		return filteringResult{behavior: EndpointUndefined}
+	}
+
+	res1 := <-received1Ch
+	res2 := <-received2Ch
+	nats.log.Debugf("recv1=%v recv2=%v", res1.received, res2.received)
+
+	for _, r := range []changeRequestResult{res1, res2} {
+		if r.err != nil {
+			return filteringResult{behavior: EndpointUndefined, err: r.err}
+		}
 	}
 
-	c, err := turn.NewClient(&turn.ClientConfig{
-		STUNServerAddr: nats.serverAddr.String(),
-		Conn:           conn,
-		LoggerFactory:  logging.NewDefaultLoggerFactory(),
-	})
+	if res1.received {
+		return filteringResult{behavior: EndpointIndependent}
+	}
+	if res2.received {
+		return filteringResult{behavior: EndpointAddrDependent}
+	}
+	return filteringResult{behavior: EndpointAddrPortDependent}
+}
+
+// Tests if the NAT hairpins, that is, if it forwards a packet sent from an
+// internal host to the mapped address of another internal host. (RFC 5780
+// Section 4.5) The test runs in the background, and the result is stored in
+// res before the returned channel is closed.
+func (nats *NATS) discoverHairpinning(ctx context.Context, res *hairpinningResult) (<-chan struct{}, error) {
+	connA, err := nats.listenPacket()
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.Listen()
+	connB, err := nats.listenPacket()
 	if err != nil {
+		connA.Close()
 		return nil, err
 	}
 
-	done := make(chan EndpointDependencyType)
+	return runInBackground(func() {
+		defer connA.Close()
+		defer connB.Close()
+		res.hairpinning, res.err = nats.hairpins(ctx, connA, connB)
+	}), nil
+}
 
-	go func() {
-		defer c.Close()
-		defer conn.Close()
+// Socket A learns its mapped address from the server, then socket B sends a
+// Binding request to it. The NAT hairpins if A receives it, which is waited
+// for no longer than Config.TransactionTimeout, or hairpinningTimeout if
+// unset.
+func (nats *NATS) hairpins(ctx context.Context, connA, connB net.PacketConn) (bool, error) {
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return false, err
+	}
 
-		received1Ch, err2 := nats.performTransactionWith(c, true, false)
-		if err2 != nil {
-			done <- EndpointUndefined
-			return
+	trRes, err := nats.roundTrip(ctx, connA, msg, nats.serverAddr, "hairpinning discovery")
+	if err != nil {
+		return false, nats.probeError("hairpinning discovery", 0, nats.serverAddr, err)
+	}
+
+	var maddr stun.XORMappedAddress
+	if err = maddr.GetFrom(trRes.msg); err != nil {
+		return false, nats.probeError("hairpinning discovery", 0, nats.serverAddr, errNoXORMappedAddress)
+	}
+
+	mappedAddr := &net.UDPAddr{IP: maddr.IP, Port: maddr.Port}
+	nats.log.Debugf("MAPPED-ADDRESS (for hairpinning discovery): %s", mappedAddr.String())
+
+	// A receives the request itself, which has the same transaction ID
+	msg, err = stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return false, err
+	}
+
+	timeout := nats.transactionTimeout
+	if timeout == 0 {
+		timeout = hairpinningTimeout
+	}
+
+	_, err = nats.roundTripWithin(ctx, connB, connA, msg, mappedAddr, timeout, "hairpinning discovery")
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, contextError(ctx, "hairpinning discovery")
 		}
-		received2Ch, err2 := nats.performTransactionWith(c, false, true)
-		if err2 != nil {
-			done <- EndpointUndefined
-			return
+		// Only the lack of the hairpinned request tells that the NAT does not
+		// hairpin
+		if errors.Is(err, errNoResponse) {
+			return false, nil
 		}
+		return false, err
+	}
 
-		received1 := <-received1Ch
-		received2 := <-received2Ch
-		if nats.verbose {
-			log.Printf("recv1=%v recv2=%v", received1, received2)
-		}
+	return true, nil
+}
 
-		if received1 {
-			done <- EndpointIndependent
-		} else {
-			if received2 {
-				done <- EndpointAddrDependent
-			} else {
-				done <- EndpointAddrPortDependent
-			}
-		}
+// Runs f in a goroutine, and returns a channel closed once f has returned.
+// The goroutine never blocks on the channel, should the caller give up
+// waiting.
+func runInBackground(f func()) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
 	}()
-
-	return done, nil
+	return done
 }
 
-func (nats *NATS) performTransactionWith(c *turn.Client, changeIP, changePort bool) (<-chan bool, error) {
+func (nats *NATS) performTransactionWith(ctx context.Context, sc *stunClient, changeIP, changePort bool) (<-chan changeRequestResult, error) {
 	attrs := []stun.Setter{
 		stun.TransactionID,
 		stun.BindingRequest,
@@ -308,49 +852,123 @@ func (nats *NATS) performTransactionWith(c *turn.Client, changeIP, changePort bo
 		return nil, err
 	}
 
-	err = (&attrChangeRequest{
+	err = (&attr.ChangeRequest{
 		ChangeIP:   changeIP,
 		ChangePort: changePort,
-	}).addAs(msg, attrTypeChangeRequest)
+	}).AddTo(msg)
 	if err != nil {
 		return nil, err
 	}
 
-	receivedCh := make(chan bool)
+	receivedCh := make(chan changeRequestResult, 1)
 
 	go func() {
-		res, err := c.PerformTransaction(msg, c.STUNServerAddr(), false)
+		res, err := nats.performTransaction(ctx, sc, msg, nats.serverAddr, "filtering behavior discovery")
 		if err != nil {
-			receivedCh <- false
+			receivedCh <- changeRequestResult{}
 			return
 		}
 
-		// Check if CHANGE-REQUEST was servered by the server
-		from := res.From.(*net.UDPAddr)
+		// Check if CHANGE-REQUEST was servered by the server. Changing the
+		// IP is the first probe, and changing the port the second.
+		from := res.from.(*net.UDPAddr)
 		if changeIP {
-			if from.IP.Equal(c.STUNServerAddr().(*net.UDPAddr).IP) {
-				nats.dfErr = fmt.Errorf("CHANGE-REQUEST ignored (IP)")
-				receivedCh <- false
+			if from.IP.Equal(nats.serverAddr.IP) {
+				receivedCh <- changeRequestResult{
+					err: nats.probeError("filtering behavior discovery", 0, nats.serverAddr, ErrChangeIPIgnored),
+				}
+				return
 			}
 		}
 		if changePort {
-			if from.Port == c.STUNServerAddr().(*net.UDPAddr).Port {
-				nats.dfErr = fmt.Errorf("CHANGE-REQUEST ignored (Port)")
-				receivedCh <- false
+			if from.Port == nats.serverAddr.Port {
+				receivedCh <- changeRequestResult{
+					err: nats.probeError("filtering behavior discovery", 1, nats.serverAddr, ErrChangePortIgnored),
+				}
+				return
 			}
 		}
 
-		receivedCh <- true
+		receivedCh <- changeRequestResult{received: true}
 	}()
 
 	return receivedCh, nil
 }
 
+// Reads the alternate address of the server from a Binding response. The
+// OTHER-ADDRESS of RFC 5780 is preferred over the CHANGED-ADDRESS of RFC 3489.
+// Also returns the name of the attribute found.
+func getOtherAddress(m *stun.Message) (*attr.Address, string, error) {
+	addr := &attr.Address{}
+	if err := addr.GetAs(m, attr.TypeOtherAddress); err == nil {
+		return addr, "OTHER-ADDRESS", nil
+	}
+	if err := addr.GetAs(m, attr.TypeChangedAddress); err == nil {
+		return addr, "CHANGED-ADDRESS", nil
+	}
+	return nil, "", errNoOtherAddress
+}
+
+// performTransaction runs a STUN transaction with sc, giving up on it once
+// ctx is done or the per-transaction timeout expires. An abandoned
+// transaction is cleaned up when sc is closed.
+func (nats *NATS) performTransaction(ctx context.Context, sc *stunClient, msg *stun.Message, to net.Addr, op string) (*transactionResult, error) {
+	return nats.authenticate(msg, func(msg *stun.Message) (*transactionResult, error) {
+		p := nats.startProbe(op, sc.conn.LocalAddr(), to, msg)
+		res, err := nats.performTransactionOnce(ctx, sc.client, msg, to, op)
+		nats.endProbe(ctx, p, res, err)
+		return res, err
+	})
+}
+
+// Performs a transaction as performTransaction does, without authentication.
+func (nats *NATS) performTransactionOnce(ctx context.Context, c *turn.Client, msg *stun.Message, to net.Addr, op string) (*transactionResult, error) {
+	parent := ctx
+	if nats.transactionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nats.transactionTimeout)
+		defer cancel()
+	}
+
+	type result struct {
+		res *transactionResult
+		err error
+	}
+
+	resultCh := make(chan result, 1)
+
+	go func() {
+		trRes, err := c.PerformTransaction(msg, to, false)
+		if err != nil {
+			// Other than failing to send, turn.Client only fails when all
+			// the retransmissions went unanswered.
+			if _, ok := err.(net.Error); !ok {
+				err = errNoResponse
+			}
+			resultCh <- result{err: err}
+			return
+		}
+		resultCh <- result{res: &transactionResult{
+			msg:     trRes.Msg,
+			from:    trRes.From,
+			retries: trRes.Retries,
+		}}
+	}()
+
+	select {
+	case r := <-resultCh:
+		return r.res, r.err
+	case <-ctx.Done():
+		return nil, transactionError(parent, ctx, op)
+	}
+}
+
 // Appends default port number if the given host name does not have it.
 func formatHostPort(host string, defaultPort int) string {
 	_, _, err := net.SplitHostPort(host)
 	if err != nil {
-		return fmt.Sprintf("%s:%d", host, defaultPort)
+		// Brackets are optional for an IPv6 literal without port
+		return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(defaultPort))
 	}
 	return host
 }
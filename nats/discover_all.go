@@ -0,0 +1,74 @@
+package nats
+
+import (
+	"context"
+	"sync"
+)
+
+// DualStackResult contains a set of results from DiscoverAll method, one per
+// address family. When the discovery for a family failed, its result is nil
+// and the error message is given instead.
+type DualStackResult struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	IPv4          *DiscoverResult `json:"ipv4,omitempty"`
+	IPv4Error     string          `json:"ipv4Error,omitempty"`
+	IPv6          *DiscoverResult `json:"ipv6,omitempty"`
+	IPv6Error     string          `json:"ipv6Error,omitempty"`
+}
+
+// DiscoverAll runs the discovery over IPv4 and IPv6 concurrently, against the
+// A and AAAA records of the server respectively. An error is returned only
+// when both of them failed, as a *DualStackError.
+func (nats *NATS) DiscoverAll(ctx context.Context) (*DualStackResult, error) {
+	ctx, cancel, err := nats.res.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var res4, res6 *DiscoverResult
+	var err4, err6 error
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		res4, err4 = nats.discoverOver(ctx, "udp4")
+	}()
+	go func() {
+		defer wg.Done()
+		res6, err6 = nats.discoverOver(ctx, "udp6")
+	}()
+	wg.Wait()
+
+	if err4 != nil && err6 != nil {
+		return nil, &DualStackError{IPv4: err4, IPv6: err6}
+	}
+
+	res := &DualStackResult{SchemaVersion: SchemaVersion, IPv4: res4, IPv6: res6}
+	if err4 != nil {
+		res.IPv4Error = err4.Error()
+	}
+	if err6 != nil {
+		res.IPv6Error = err6.Error()
+	}
+
+	return res, nil
+}
+
+// Runs the discovery on a copy of this instance set up for the given network.
+func (nats *NATS) discoverOver(ctx context.Context, network string) (*DiscoverResult, error) {
+	if len(nats.servers) > 0 {
+		n := *nats
+		n.network = network
+		n.serverAddr = nil
+		return n.DiscoverContext(ctx)
+	}
+
+	n, err := nats.withServer(network, nats.server)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.DiscoverContext(ctx)
+}
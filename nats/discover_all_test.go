@@ -0,0 +1,90 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverAll(t *testing.T) {
+	t.Run("IPv4 only network", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointAddrPortDependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 500 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		res, err := nats.DiscoverAll(context.Background())
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		if assert.NotNil(t, res.IPv4, "should have IPv4 result") {
+			assert.Equal(t, "udp4", res.IPv4.Network, "should match")
+			assert.Equal(t, NATTypeSymmetric, res.IPv4.NATType, "should match")
+		}
+		assert.Empty(t, res.IPv4Error, "should be empty")
+
+		// vnet does not support IPv6
+		assert.Nil(t, res.IPv6, "should not have IPv6 result")
+		assert.NotEmpty(t, res.IPv6Error, "should have IPv6 error")
+	})
+
+	t.Run("Both failed", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+			return false
+		})
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 500 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		_, err = nats.DiscoverAll(context.Background())
+		if !assert.Error(t, err, "should fail") {
+			return
+		}
+
+		var dserr *DualStackError
+		if assert.True(t, errors.As(err, &dserr), "should be a DualStackError") {
+			assert.True(t, errors.Is(dserr.IPv4, ErrUDPBlocked), "should match: %v", dserr.IPv4)
+			assert.Error(t, dserr.IPv6, "should have IPv6 error")
+		}
+
+		// Through to the errors of the families
+		assert.True(t, errors.Is(err, ErrUDPBlocked), "should match: %v", err)
+		var derr *DiscoveryError
+		if assert.True(t, errors.As(err, &derr), "should be a DiscoveryError") {
+			assert.Equal(t, "mapping behavior discovery", derr.Op, "should match")
+		}
+	})
+}
@@ -1,26 +1,113 @@
 package nats
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/enobufs/go-nats/server"
 	"github.com/pion/logging"
+	"github.com/pion/stun"
 	"github.com/pion/transport/vnet"
 	"github.com/stretchr/testify/assert"
 )
 
 type virtualNet struct {
-	wan    *vnet.Router
-	net0   *vnet.Net
-	server *STUNServer
+	wan           *vnet.Router
+	net0          *vnet.Net
+	server        *server.Server
+	extraServers  []*server.Server
+	loggerFactory logging.LoggerFactory
 }
 
 func (v *virtualNet) close() {
 	v.server.Close() // nolint:errcheck,gosec
-	v.wan.Stop()     // nolint:errcheck,gosec
+	for _, s := range v.extraServers {
+		s.Close() // nolint:errcheck,gosec
+	}
+	v.wan.Stop() // nolint:errcheck,gosec
+}
+
+// Runs another STUN server on the WAN, listening on the two IP addresses with
+// ports 3478 and 3479.
+func (v *virtualNet) addServer(hostName, primaryIP, secondaryIP string) (*server.Server, error) {
+	serverNet := vnet.NewNet(&vnet.NetConfig{
+		StaticIPs: []string{primaryIP, secondaryIP},
+	})
+
+	err := v.wan.AddNet(serverNet)
+	if err != nil {
+		return nil, err
+	}
+
+	err = v.wan.AddHost(hostName, primaryIP)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := server.NewServer(&server.Config{
+		PrimaryAddress:   primaryIP + ":3478",
+		SecondaryAddress: secondaryIP + ":3479",
+		Net:              serverNet,
+		LoggerFactory:    v.loggerFactory,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	v.extraServers = append(v.extraServers, s)
+	return s, nil
+}
+
+// Adds another LAN behind a NAT with the given external IP, or a host on the
+// WAN if natType is nil.
+func (v *virtualNet) addLAN(externalIP, cidr string, natType *vnet.NATType) (*vnet.Net, error) {
+	if natType == nil {
+		n := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{externalIP}})
+		return n, v.wan.AddNet(n)
+	}
+
+	lan, err := vnet.NewRouter(&vnet.RouterConfig{
+		StaticIP:      externalIP,
+		CIDR:          cidr,
+		NATType:       natType,
+		LoggerFactory: v.loggerFactory,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	n := vnet.NewNet(&vnet.NetConfig{})
+	err = lan.AddNet(n)
+	if err != nil {
+		return nil, err
+	}
+
+	err = v.wan.AddRouter(lan)
+	if err != nil {
+		return nil, err
+	}
+
+	// The WAN has already started
+	return n, lan.Start()
 }
 
 func buildVNet(natType *vnet.NATType) (*virtualNet, error) {
+	return buildVNetWithServer(natType, nil)
+}
+
+// Builds the virtual network, letting the caller modify the config of the
+// STUN server before it starts.
+func buildVNetWithServer(natType *vnet.NATType, configure func(config *server.Config)) (*virtualNet, error) {
 	loggerFactory := logging.NewDefaultLoggerFactory()
 
 	// WAN
@@ -75,25 +162,31 @@ func buildVNet(natType *vnet.NATType) (*virtualNet, error) {
 	}
 
 	// Run STUN server
-	server, err := NewSTUNServer(&STUNServerConfig{
+	serverConfig := &server.Config{
 		PrimaryAddress:   "1.2.3.4:3478",
 		SecondaryAddress: "1.2.3.5:3479",
 		Net:              wanNet,
 		LoggerFactory:    loggerFactory,
-	})
+	}
+	if configure != nil {
+		configure(serverConfig)
+	}
+
+	s, err := server.NewServer(serverConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	err = server.Start()
+	err = s.Start()
 	if err != nil {
 		return nil, err
 	}
 
 	return &virtualNet{
-		wan:    wan,
-		net0:   net0,
-		server: server,
+		wan:           wan,
+		net0:          net0,
+		server:        s,
+		loggerFactory: loggerFactory,
 	}, nil
 }
 
@@ -138,8 +231,11 @@ func TestDiscoverOnVNet(t *testing.T) {
 		assert.Equal(t, EndpointIndependent, res.MappingBehavior, "should match")
 		assert.Equal(t, EndpointIndependent, res.FilteringBehavior, "should match")
 		assert.False(t, res.PortPreservation, "should not be port preserved")
-		assert.Equal(t, "Full cone NAT", res.NATType, "should match")
+		assert.Equal(t, NATTypeFullCone, res.NATType, "should match")
 		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
+		assert.True(t, res.Hairpinning, "should hairpin")
+		assert.Equal(t, "udp4", res.Network, "should match")
+		assert.Equal(t, TranslationNAT, res.Translation, "should match")
 	})
 
 	t.Run("Restricted cone NAT", func(t *testing.T) {
@@ -176,8 +272,9 @@ func TestDiscoverOnVNet(t *testing.T) {
 		assert.Equal(t, EndpointIndependent, res.MappingBehavior, "should match")
 		assert.Equal(t, EndpointAddrDependent, res.FilteringBehavior, "should match")
 		assert.False(t, res.PortPreservation, "should not be port preserved")
-		assert.Equal(t, "Address-restricted cone NAT", res.NATType, "should match")
+		assert.Equal(t, NATTypeAddrRestrictedCone, res.NATType, "should match")
 		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
+		assert.False(t, res.Hairpinning, "should not hairpin")
 	})
 
 	t.Run("Port-restricted cone NAT", func(t *testing.T) {
@@ -214,8 +311,9 @@ func TestDiscoverOnVNet(t *testing.T) {
 		assert.Equal(t, EndpointIndependent, res.MappingBehavior, "should match")
 		assert.Equal(t, EndpointAddrPortDependent, res.FilteringBehavior, "should match")
 		assert.False(t, res.PortPreservation, "should not be port preserved")
-		assert.Equal(t, "Port-restricted cone NAT", res.NATType, "should match")
+		assert.Equal(t, NATTypePortRestrictedCone, res.NATType, "should match")
 		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
+		assert.False(t, res.Hairpinning, "should not hairpin")
 	})
 
 	t.Run("Symmetric NAT", func(t *testing.T) {
@@ -252,7 +350,7 @@ func TestDiscoverOnVNet(t *testing.T) {
 		assert.Equal(t, EndpointAddrPortDependent, res.MappingBehavior, "should match")
 		assert.Equal(t, EndpointAddrPortDependent, res.FilteringBehavior, "should match")
 		assert.False(t, res.PortPreservation, "should not be port preserved")
-		assert.Equal(t, "Symmetric NAT", res.NATType, "should match")
+		assert.Equal(t, NATTypeSymmetric, res.NATType, "should match")
 		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
 	})
 
@@ -290,7 +388,428 @@ func TestDiscoverOnVNet(t *testing.T) {
 		assert.Equal(t, EndpointAddrDependent, res.MappingBehavior, "should match")
 		assert.Equal(t, EndpointAddrPortDependent, res.FilteringBehavior, "should match")
 		assert.False(t, res.PortPreservation, "should not be port preserved")
-		assert.Equal(t, "Symmetric NAT", res.NATType, "should match")
+		assert.Equal(t, NATTypeSymmetric, res.NATType, "should match")
 		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
 	})
 }
+
+func TestDiscoverContext(t *testing.T) {
+	t.Run("Transaction timeout", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 500 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		start := time.Now()
+		res, err := nats.DiscoverContext(context.Background())
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.True(t, time.Since(start) < 3*time.Second, "should not wait for all retransmissions")
+		assert.Equal(t, EndpointAddrPortDependent, res.FilteringBehavior, "should match")
+		assert.Equal(t, NATTypePortRestrictedCone, res.NATType, "should match")
+	})
+
+	t.Run("Overall timeout", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		// Server never responds
+		v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+			return false
+		})
+
+		nats, err := NewNATS(&Config{
+			Server:  "stun.pion.net:3478",
+			Net:     v.net0,
+			Timeout: 500 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		start := time.Now()
+		_, err = nats.DiscoverContext(context.Background())
+		assert.True(t, time.Since(start) < 2*time.Second, "should return promptly")
+		if assert.Error(t, err, "should fail") {
+			terr, ok := err.(*TimeoutError)
+			if assert.True(t, ok, "should be a TimeoutError") {
+				assert.True(t, terr.Timeout(), "should be a timeout")
+			}
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+			return false
+		})
+
+		nats, err := NewNATS(&Config{
+			Server: "stun.pion.net:3478",
+			Net:    v.net0,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(200*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err = nats.DiscoverContext(ctx)
+		assert.True(t, time.Since(start) < time.Second, "should return promptly")
+		assert.Equal(t, context.Canceled, err, "should be canceled")
+	})
+}
+
+func TestDiscoverConcurrently(t *testing.T) {
+	v, err := buildVNet(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointAddrDependent,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	nats, err := NewNATS(&Config{
+		Server:             "stun.pion.net:3478",
+		Net:                v.net0,
+		TransactionTimeout: 500 * time.Millisecond,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	const numWorkers = 4
+	results := make([]*DiscoverResult, numWorkers)
+	errs := make([]error, numWorkers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = nats.Discover()
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < numWorkers; i++ {
+		if !assert.NoError(t, errs[i], "should succeed") {
+			continue
+		}
+		assert.Equal(t, EndpointIndependent, results[i].MappingBehavior, "should match")
+		assert.Equal(t, EndpointAddrDependent, results[i].FilteringBehavior, "should match")
+		assert.Equal(t, NATTypeAddrRestrictedCone, results[i].NATType, "should match")
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	t.Run("NPTv6 address pair", func(t *testing.T) {
+		// Example from RFC 6296 Section 3.7
+		internal := net.ParseIP("fd01:203:405:1::1234")
+		external := net.ParseIP("2001:db8:1:d550::1234")
+		assert.True(t, isNPTv6Pair(internal, external), "should be NPTv6 pair")
+		assert.False(t, isNPTv6Pair(internal, net.ParseIP("2001:db8:1:d551::1234")), "should not be NPTv6 pair")
+		assert.False(t, isNPTv6Pair(external, external), "same address is not translated")
+	})
+
+	t.Run("Translation of IPv6 address", func(t *testing.T) {
+		nats := &NATS{network: "udp6", net: vnet.NewNet(&vnet.NetConfig{})}
+		mapped := &net.UDPAddr{IP: net.ParseIP("2001:db8:1:d550::1234"), Port: 5000}
+
+		// No local address could be the internal address
+		assert.Equal(t, TranslationNAT, nats.findTranslation(mapped, 5000, EndpointIndependent), "should match")
+		// Port is rewritten
+		assert.Equal(t, TranslationNAT, nats.findTranslation(mapped, 5001, EndpointIndependent), "should match")
+		// IPv4 is always NAT
+		mapped4 := &net.UDPAddr{IP: net.ParseIP("27.1.1.1"), Port: 5000}
+		assert.Equal(t, TranslationNAT, nats.findTranslation(mapped4, 5000, EndpointIndependent), "should match")
+	})
+
+	t.Run("Format host and port", func(t *testing.T) {
+		assert.Equal(t, "stun.pion.net:3478", formatHostPort("stun.pion.net", 3478), "should match")
+		assert.Equal(t, "stun.pion.net:10000", formatHostPort("stun.pion.net:10000", 3478), "should match")
+		assert.Equal(t, "[2001:db8::1]:3478", formatHostPort("2001:db8::1", 3478), "should match")
+		assert.Equal(t, "[2001:db8::1]:3478", formatHostPort("[2001:db8::1]", 3478), "should match")
+		assert.Equal(t, "[2001:db8::1]:10000", formatHostPort("[2001:db8::1]:10000", 3478), "should match")
+	})
+
+	t.Run("Unsupported network", func(t *testing.T) {
+		_, err := NewNATS(&Config{
+			Server:  "stun.pion.net:3478",
+			Network: "tcp",
+		})
+		assert.Error(t, err, "should fail")
+	})
+}
+
+func TestDiscoverUDP6(t *testing.T) {
+	// The alternate address needs a second IPv6 address besides [::1], which
+	// is not available everywhere.
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("::1 is not available")
+	}
+	conn.Close() // nolint:errcheck,gosec
+
+	var secIP net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skip("interface addresses are not available")
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() {
+			secIP = ipNet.IP
+			break
+		}
+	}
+	if secIP == nil {
+		t.Skip("no IPv6 address other than ::1 is available")
+	}
+
+	s, err := server.NewServer(&server.Config{
+		PrimaryAddress:   "[::1]:34980",
+		SecondaryAddress: net.JoinHostPort(secIP.String(), "34981"),
+		LoggerFactory:    logging.NewDefaultLoggerFactory(),
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, s.Start(), "should succeed") {
+		return
+	}
+	defer s.Close() // nolint:errcheck,gosec
+
+	nats, err := NewNATS(&Config{
+		Server:  "[::1]:34980",
+		Network: "udp6",
+		Verbose: true,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	res, err := nats.DiscoverContext(context.Background())
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	assert.Equal(t, "udp6", res.Network, "should match")
+	assert.Equal(t, AlgorithmRFC5780, res.Algorithm, "should match")
+	assert.Equal(t, "::1", res.ExternalIP, "should match")
+	assert.Equal(t, "OTHER-ADDRESS", res.AlternateAddressAttr, "should match")
+
+	// The address is native, and nothing filters the responses from the
+	// alternate address.
+	assert.False(t, res.IsNatted, "should not be natted")
+	assert.Equal(t, TranslationNone, res.Translation, "should be native")
+	assert.Equal(t, EndpointIndependent, res.FilteringBehavior, "should match")
+	assert.Equal(t, NATTypeOpenInternet, res.NATType, "should match")
+}
+
+func TestAlternateAddress(t *testing.T) {
+	testCases := []struct {
+		name     string
+		attrs    []stun.AttrType
+		expected string
+	}{
+		{"RFC 5780 server", []stun.AttrType{server.AttrTypeOtherAddress}, "OTHER-ADDRESS"},
+		{"RFC 3489 server", []stun.AttrType{server.AttrTypeChangedAddress}, "CHANGED-ADDRESS"},
+		{"Server sending both", []stun.AttrType{server.AttrTypeChangedAddress, server.AttrTypeOtherAddress}, "OTHER-ADDRESS"},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := buildVNetWithServer(&vnet.NATType{
+				MappingBehavior:   vnet.EndpointAddrDependent,
+				FilteringBehavior: vnet.EndpointAddrDependent,
+			}, func(config *server.Config) {
+				config.AlternateAddressAttrs = tc.attrs
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+
+			nats, err := NewNATS(&Config{
+				Server:             "stun.pion.net:3478",
+				Net:                v.net0,
+				TransactionTimeout: 500 * time.Millisecond,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			res, err := nats.Discover()
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			assert.Equal(t, tc.expected, res.AlternateAddressAttr, "should match")
+			assert.Equal(t, EndpointAddrDependent, res.MappingBehavior, "should match")
+			assert.Equal(t, EndpointAddrDependent, res.FilteringBehavior, "should match")
+			assert.Equal(t, NATTypeSymmetric, res.NATType, "should match")
+		})
+	}
+
+	t.Run("No alternate address", func(t *testing.T) {
+		m, err := stun.Build(stun.TransactionID, stun.BindingSuccess)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		_, _, err = getOtherAddress(m)
+		assert.True(t, errors.Is(err, ErrNoRFC5780Support), "should fail")
+	})
+}
+
+func TestHairpinning(t *testing.T) {
+	// vnet hairpins a packet when its filtering behavior lets it in
+	testCases := []struct {
+		name        string
+		filtering   vnet.EndpointDependencyType
+		hairpinning bool
+	}{
+		{"Hairpinning", vnet.EndpointIndependent, true},
+		{"No hairpinning", vnet.EndpointAddrPortDependent, false},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := buildVNet(&vnet.NATType{
+				MappingBehavior:   vnet.EndpointIndependent,
+				FilteringBehavior: tc.filtering,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+
+			nats, err := NewNATS(&Config{
+				Server:             "stun.pion.net:3478",
+				Net:                v.net0,
+				TransactionTimeout: 500 * time.Millisecond,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			res, err := nats.Discover()
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			assert.Equal(t, tc.hairpinning, res.Hairpinning, "should match")
+		})
+	}
+	t.Run("Bounded without TransactionTimeout", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server: "stun.pion.net:3478",
+			Net:    v.net0,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		res := &hairpinningResult{}
+		done, err := nats.discoverHairpinning(context.Background(), res)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatal("should give up within hairpinningTimeout")
+		}
+		assert.NoError(t, res.err, "should succeed")
+		assert.False(t, res.hairpinning, "should not hairpin")
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 200 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		// Canceled
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		res := &hairpinningResult{}
+		done, err := nats.discoverHairpinning(ctx, res)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		<-done
+		assert.True(t, errors.Is(res.err, context.Canceled), "should be canceled")
+		assert.False(t, res.hairpinning, "should not hairpin")
+
+		// The server not responding is not a lack of hairpinning
+		v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+			return false
+		})
+		res = &hairpinningResult{}
+		done, err = nats.discoverHairpinning(context.Background(), res)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		<-done
+		assert.True(t, errors.Is(res.err, ErrUDPBlocked), "should be blocked")
+		assert.False(t, res.hairpinning, "should not hairpin")
+	})
+}
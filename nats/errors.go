@@ -0,0 +1,217 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Reasons a discovery fails for, found in the chain of a *DiscoveryError.
+// Test them with errors.Is.
+var (
+	// ErrServerUnreachable means a request could not be sent or a connection
+	// could not be made to the server, or that the alternate address of the
+	// server did not respond. Another server may do better.
+	ErrServerUnreachable = errors.New("STUN server unreachable")
+	// ErrUDPBlocked means a request to the primary address of the server got
+	// no response, either because UDP is blocked on the way or because the
+	// server is down.
+	ErrUDPBlocked = errors.New("no response from STUN server (UDP blocked?)")
+	// ErrNoRFC5780Support means the server does not provide what the RFC
+	// 5780 discovery needs: an alternate address, or honoring CHANGE-REQUEST.
+	// AlgorithmRFC3489 may still work with it.
+	ErrNoRFC5780Support = errors.New("STUN server lacks RFC 5780 support")
+	// ErrChangeIPIgnored means the response to CHANGE-REQUEST asking for
+	// another IP came from the same IP. It is also an ErrNoRFC5780Support.
+	ErrChangeIPIgnored error = &kindError{ErrNoRFC5780Support, errors.New("CHANGE-REQUEST ignored (IP)")}
+	// ErrChangePortIgnored means the response to CHANGE-REQUEST asking for
+	// another port came from the same port. It is also an
+	// ErrNoRFC5780Support.
+	ErrChangePortIgnored error = &kindError{ErrNoRFC5780Support, errors.New("CHANGE-REQUEST ignored (Port)")}
+	// ErrMalformedResponse means a response lacked the mapped address or was
+	// otherwise unusable.
+	ErrMalformedResponse = errors.New("malformed response")
+	// ErrUnauthorized means the server rejected the request for missing or
+	// bad credentials.
+	ErrUnauthorized = errors.New("unauthorized: credentials missing or rejected")
+	// ErrIntegrityMismatch means a response failed the integrity check with
+	// Config.Credentials.
+	ErrIntegrityMismatch = errors.New("response failed the integrity check")
+)
+
+// ErrClosed is returned by the methods of a NATS instance once closed.
+var ErrClosed = errors.New("NATS closed")
+
+var (
+	errNoXORMappedAddress = &kindError{ErrMalformedResponse, errors.New("XOR-MAPPED-ADDRESS not found")}
+	errNoOtherAddress     = &kindError{ErrNoRFC5780Support, errors.New("neither OTHER-ADDRESS nor CHANGED-ADDRESS found")}
+	errNoResponse         = errors.New("no response")
+)
+
+// DiscoveryError is returned when a request to the server fails for a reason
+// other than running out of time. Err is, or wraps, one of the Err* errors
+// above, possibly along with an error of the network.
+type DiscoveryError struct {
+	Op     string   // what was in progress, e.g. "mapping behavior discovery"
+	Probe  int      // index of the request within Op, from 0
+	Server string   // host:port of the server as configured
+	Addr   net.Addr // address the request was sent to
+	Err    error
+}
+
+func (e *DiscoveryError) Error() string {
+	return fmt.Sprintf("%s: probe %d to %s (%s): %s",
+		e.Op, e.Probe, e.Server, e.Addr.String(), e.Err.Error())
+}
+
+// Unwrap returns Err.
+func (e *DiscoveryError) Unwrap() error {
+	return e.Err
+}
+
+// DualStackError is returned by DiscoverAll when the discoveries over both
+// IPv4 and IPv6 failed. errors.Is and errors.As look into both of the errors.
+type DualStackError struct {
+	IPv4 error
+	IPv6 error
+}
+
+func (e *DualStackError) Error() string {
+	return fmt.Sprintf("IPv4: %s, IPv6: %s", e.IPv4.Error(), e.IPv6.Error())
+}
+
+// Is tells if either of the errors is target.
+func (e *DualStackError) Is(target error) bool {
+	return errors.Is(e.IPv4, target) || errors.Is(e.IPv6, target)
+}
+
+// As finds the first error that matches target, looking into IPv4 first.
+func (e *DualStackError) As(target interface{}) bool {
+	return errors.As(e.IPv4, target) || errors.As(e.IPv6, target)
+}
+
+// MultiServerError is returned when the discoveries against all the servers
+// given by Config.Servers failed. errors.Is and errors.As look into the errors
+// of all the servers.
+type MultiServerError struct {
+	Servers []*ServerResult
+}
+
+func (e *MultiServerError) Error() string {
+	var errs []string
+	for _, sr := range e.Servers {
+		errs = append(errs, fmt.Sprintf("%s: %s", sr.Server, sr.Error))
+	}
+	return fmt.Sprintf("all servers failed: %s", strings.Join(errs, ", "))
+}
+
+// Is tells if the error of any of the servers is target.
+func (e *MultiServerError) Is(target error) bool {
+	for _, sr := range e.Servers {
+		if sr.Err != nil && errors.Is(sr.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error that matches target, in the order of Servers.
+func (e *MultiServerError) As(target interface{}) bool {
+	for _, sr := range e.Servers {
+		if sr.Err != nil && errors.As(sr.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// kindError is one of the Err* errors for errors.Is, with the details in
+// cause.
+type kindError struct {
+	kind  error
+	cause error
+}
+
+func (e *kindError) Error() string {
+	return fmt.Sprintf("%s: %s", e.kind.Error(), e.cause.Error())
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.cause
+}
+
+// Wraps the error of the given probe into a *DiscoveryError, classifying
+// the errors of the network. Errors of the context are returned as they are.
+func (nats *NATS) probeError(op string, probe int, to net.Addr, err error) error {
+	switch err.(type) {
+	case *TimeoutError, *DiscoveryError:
+		return err
+	}
+	if err == context.Canceled {
+		return err
+	}
+
+	if errors.Is(err, errNoResponse) {
+		udpAddr, ok := to.(*net.UDPAddr)
+		if ok && udpAddr.IP.Equal(nats.serverAddr.IP) && udpAddr.Port == nats.serverAddr.Port {
+			err = &kindError{ErrUDPBlocked, err}
+		} else {
+			err = &kindError{ErrServerUnreachable, err}
+		}
+	} else if _, ok := err.(net.Error); ok {
+		err = &kindError{ErrServerUnreachable, err}
+	}
+
+	return &DiscoveryError{
+		Op:     op,
+		Probe:  probe,
+		Server: nats.server,
+		Addr:   to,
+		Err:    err,
+	}
+}
+
+// TimeoutError is returned when a discovery did not complete in time, either
+// because Config.Timeout, Config.TransactionTimeout or the deadline of the
+// given context expired.
+type TimeoutError struct {
+	Op string // what was in progress, e.g. "mapping behavior discovery"
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out", e.Op)
+}
+
+// Timeout always returns true. (compatible with net.Error)
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary always returns true. (compatible with net.Error)
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+// Converts the error of a done context into the error returned to the caller.
+func contextError(ctx context.Context, op string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Op: op}
+	}
+	return ctx.Err()
+}
+
+// Converts the error of the done context of a transaction, derived from
+// parent, into the error returned. The transaction timeout expiring before
+// parent is done means that no response came.
+func transactionError(parent, ctx context.Context, op string) error {
+	if parent.Err() == nil {
+		return &kindError{errNoResponse, contextError(ctx, op)}
+	}
+	return contextError(ctx, op)
+}
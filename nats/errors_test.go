@@ -0,0 +1,116 @@
+package nats
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/enobufs/go-nats/server"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoveryError(t *testing.T) {
+	natType := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+
+	testCases := []struct {
+		name      string
+		configure func(config *server.Config)
+		drop      string // destination address to drop the requests to
+		err       error
+		op        string
+		probe     int
+	}{
+		{
+			name:  "UDP blocked",
+			drop:  "1.2.3.4:3478",
+			err:   ErrUDPBlocked,
+			op:    "mapping behavior discovery",
+			probe: 0,
+		},
+		{
+			name:  "Alternate address unreachable",
+			drop:  "1.2.3.4:3479",
+			err:   ErrServerUnreachable,
+			op:    "mapping behavior discovery",
+			probe: 1,
+		},
+		{
+			name: "Malformed response",
+			configure: func(config *server.Config) {
+				config.LegacyMappedAddress = true
+			},
+			err:   ErrMalformedResponse,
+			op:    "mapping behavior discovery",
+			probe: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := buildVNetWithServer(natType, tc.configure)
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+
+			if len(tc.drop) > 0 {
+				v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+					return c.DestinationAddr().String() != tc.drop
+				})
+			}
+
+			nats, err := NewNATS(&Config{
+				Server:             "stun.pion.net:3478",
+				Net:                v.net0,
+				TransactionTimeout: 300 * time.Millisecond,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			_, err = nats.Discover()
+			assert.True(t, errors.Is(err, tc.err), "should match: %v", err)
+
+			var derr *DiscoveryError
+			if assert.True(t, errors.As(err, &derr), "should be a DiscoveryError") {
+				assert.Equal(t, tc.op, derr.Op, "should match")
+				assert.Equal(t, tc.probe, derr.Probe, "should match")
+				assert.Equal(t, "stun.pion.net:3478", derr.Server, "should match")
+			}
+		})
+	}
+
+	t.Run("CHANGE-REQUEST ignored", func(t *testing.T) {
+		v, err := buildVNetWithServer(natType, func(config *server.Config) {
+			config.IgnoreChangeRequest = true
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 300 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		_, err = nats.Discover()
+		assert.True(t, errors.Is(err, ErrNoRFC5780Support), "should match: %v", err)
+		assert.True(t, errors.Is(err, ErrChangeIPIgnored), "should match: %v", err)
+
+		var derr *DiscoveryError
+		if assert.True(t, errors.As(err, &derr), "should be a DiscoveryError") {
+			assert.Equal(t, "filtering behavior discovery", derr.Op, "should match")
+			assert.Equal(t, 0, derr.Probe, "should match")
+		}
+	})
+}
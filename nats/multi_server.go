@@ -0,0 +1,161 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ServerResult contains the outcome of the discovery against one of the
+// servers given by Config.Servers.
+type ServerResult struct {
+	Server string          `json:"server"`
+	Result *DiscoverResult `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	// Err is the error Error tells of, for errors.Is and errors.As.
+	Err error `json:"-"`
+}
+
+// Returns a copy of this instance set up to query the given server over the
+// given network.
+func (nats *NATS) withServer(network, server string) (*NATS, error) {
+	serverAddr, err := nats.net.ResolveUDPAddr(network, server)
+	if err != nil {
+		return nil, err
+	}
+
+	n := *nats
+	n.network = network
+	n.server = server
+	n.servers = nil
+	n.serverAddr = serverAddr
+
+	return &n, nil
+}
+
+// Queries all the servers concurrently and merges the results.
+func (nats *NATS) discoverFromServers(ctx context.Context) (*DiscoverResult, error) {
+	srvResults := make([]*ServerResult, len(nats.servers))
+
+	var wg sync.WaitGroup
+	for i, server := range nats.servers {
+		srvResults[i] = &ServerResult{Server: server}
+
+		wg.Add(1)
+		go func(srvRes *ServerResult) {
+			defer wg.Done()
+
+			n, err := nats.withServer(nats.network, srvRes.Server)
+			if err == nil {
+				srvRes.Result, err = n.discover(ctx)
+			}
+			if err != nil {
+				srvRes.Error = err.Error()
+				srvRes.Err = err
+			}
+		}(srvResults[i])
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, contextError(ctx, "discovery")
+	}
+
+	return mergeResults(srvResults)
+}
+
+// Merges the results from multiple servers. The result agreed on by the most
+// servers (the first one in case of a tie) is taken, and its Confidence is
+// the ratio of the servers that agreed to all the servers queried. If none
+// succeeded, a *MultiServerError is returned.
+func mergeResults(srvResults []*ServerResult) (*DiscoverResult, error) {
+	var succeeded []*ServerResult
+	for _, sr := range srvResults {
+		if sr.Result != nil {
+			succeeded = append(succeeded, sr)
+		}
+	}
+
+	if len(succeeded) == 0 {
+		return nil, &MultiServerError{Servers: srvResults}
+	}
+
+	// Vote on the classification
+	votes := map[NATType]int{}
+	var majority *DiscoverResult
+	for _, sr := range succeeded {
+		votes[sr.Result.NATType]++
+		if majority == nil || votes[sr.Result.NATType] > votes[majority.NATType] {
+			majority = sr.Result
+		}
+	}
+
+	res := *majority
+	res.Servers = srvResults
+	res.Trace = nil // found in each of res.Servers
+	res.Confidence = float64(votes[majority.NATType]) / float64(len(srvResults))
+
+	fields := []struct {
+		name  string
+		value func(r *DiscoverResult) string
+		note  string
+	}{
+		{"natType", func(r *DiscoverResult) string { return r.NATType.String() }, ""},
+		{"mappingBehavior", func(r *DiscoverResult) string { return r.MappingBehavior.RFC4787Name() }, ""},
+		{"filteringBehavior", func(r *DiscoverResult) string { return r.FilteringBehavior.RFC4787Name() }, ""},
+		{"externalIP", func(r *DiscoverResult) string { return r.ExternalIP },
+			"different external IPs imply address pooling"},
+		{"portPreservation", func(r *DiscoverResult) string { return fmt.Sprint(r.PortPreservation) }, ""},
+		{"hairpinning", func(r *DiscoverResult) string { return fmt.Sprint(r.Hairpinning) }, ""},
+		{"tcp.mappingBehavior", func(r *DiscoverResult) string {
+			if r.TCP == nil {
+				return ""
+			}
+			return r.TCP.MappingBehavior.RFC4787Name()
+		}, ""},
+	}
+
+	for _, f := range fields {
+		if d := findDisagreement(succeeded, f.name, f.value); len(d) > 0 {
+			if len(f.note) > 0 {
+				d += "; " + f.note
+			}
+			res.Disagreements = append(res.Disagreements, d)
+		}
+	}
+
+	return &res, nil
+}
+
+// Describes how the servers disagree on a field, such as
+// "natType: full-cone (a, b), symmetric (c)", or returns an empty string if
+// they all agree.
+func findDisagreement(srvResults []*ServerResult, name string, value func(r *DiscoverResult) string) string {
+	serversByValue := map[string][]string{}
+	var values []string
+	for _, sr := range srvResults {
+		v := value(sr.Result)
+		if _, ok := serversByValue[v]; !ok {
+			values = append(values, v)
+		}
+		serversByValue[v] = append(serversByValue[v], sr.Server)
+	}
+
+	if len(values) < 2 {
+		return ""
+	}
+
+	// Most agreed value first
+	sort.SliceStable(values, func(i, j int) bool {
+		return len(serversByValue[values[i]]) > len(serversByValue[values[j]])
+	})
+
+	var parts []string
+	for _, v := range values {
+		parts = append(parts, fmt.Sprintf("%s (%s)", v, strings.Join(serversByValue[v], ", ")))
+	}
+
+	return fmt.Sprintf("%s: %s", name, strings.Join(parts, ", "))
+}
@@ -0,0 +1,194 @@
+package nats
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultipleServers(t *testing.T) {
+	t.Run("Consensus with a misbehaving server", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		_, err = v.addServer("stun2.pion.net", "1.2.3.6", "1.2.3.7")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		_, err = v.addServer("stun3.pion.net", "1.2.3.8", "1.2.3.9")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		// A middlebox on the path to stun3 lets packets from its secondary IP
+		// in only to those who have sent to it, misleading the client into
+		// finding an address dependent filtering.
+		badIP := net.ParseIP("1.2.3.9")
+		permitted := map[string]bool{}
+		var mutex sync.Mutex
+		v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if c.DestinationAddr().(*net.UDPAddr).IP.Equal(badIP) {
+				permitted[c.SourceAddr().String()] = true
+				return true
+			}
+			if c.SourceAddr().(*net.UDPAddr).IP.Equal(badIP) {
+				return permitted[c.DestinationAddr().String()]
+			}
+			return true
+		})
+
+		nats, err := NewNATS(&Config{
+			Servers: []string{
+				"stun.pion.net",
+				"stun2.pion.net",
+				"stun3.pion.net",
+			},
+			Net:                v.net0,
+			TransactionTimeout: 500 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		res, err := nats.Discover()
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.Equal(t, NATTypeFullCone, res.NATType, "majority should win")
+		assert.Equal(t, EndpointIndependent, res.FilteringBehavior, "majority should win")
+		assert.InDelta(t, 2.0/3.0, res.Confidence, 0.001, "should match")
+
+		if assert.Equal(t, 3, len(res.Servers), "should have result per server") {
+			assert.Equal(t, "stun3.pion.net:3478", res.Servers[2].Server, "should match")
+			if assert.NotNil(t, res.Servers[2].Result, "should succeed") {
+				assert.Equal(t, NATTypeAddrRestrictedCone, res.Servers[2].Result.NATType, "should match")
+			}
+		}
+
+		assert.Contains(t, res.Disagreements,
+			"natType: full-cone (stun.pion.net:3478, stun2.pion.net:3478), "+
+				"address-restricted-cone (stun3.pion.net:3478)")
+		assert.Equal(t, 2, len(res.Disagreements), "should disagree on natType and filteringBehavior")
+	})
+
+	t.Run("Unresolvable server", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointAddrPortDependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Servers:            []string{"stun.pion.net", "nowhere.pion.net"},
+			Net:                v.net0,
+			TransactionTimeout: 500 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		res, err := nats.Discover()
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.Equal(t, NATTypeSymmetric, res.NATType, "should match")
+		assert.InDelta(t, 0.5, res.Confidence, 0.001, "should match")
+		assert.Empty(t, res.Disagreements, "should not disagree")
+		if assert.Equal(t, 2, len(res.Servers), "should have result per server") {
+			assert.Nil(t, res.Servers[1].Result, "should fail")
+			assert.NotEmpty(t, res.Servers[1].Error, "should fail")
+			assert.Error(t, res.Servers[1].Err, "should fail")
+		}
+	})
+
+	t.Run("All failed", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+			return false
+		})
+
+		nats, err := NewNATS(&Config{
+			Servers:            []string{"nowhere.pion.net", "stun.pion.net"},
+			Net:                v.net0,
+			TransactionTimeout: 200 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		_, err = nats.Discover()
+		if !assert.Error(t, err, "should fail") {
+			return
+		}
+
+		var merr *MultiServerError
+		if assert.True(t, errors.As(err, &merr), "should be a MultiServerError") {
+			assert.Equal(t, 2, len(merr.Servers), "should have result per server")
+		}
+
+		// Through to the errors of the servers
+		assert.True(t, errors.Is(err, ErrUDPBlocked), "should match: %v", err)
+		var derr *DiscoveryError
+		if assert.True(t, errors.As(err, &derr), "should be a DiscoveryError") {
+			assert.Equal(t, "stun.pion.net:3478", derr.Server, "should match")
+		}
+	})
+}
+
+func TestMergeResults(t *testing.T) {
+	t.Run("Address pooling", func(t *testing.T) {
+		res, err := mergeResults([]*ServerResult{
+			{Server: "a", Result: &DiscoverResult{NATType: NATTypeFullCone, ExternalIP: "27.1.1.1"}},
+			{Server: "b", Result: &DiscoverResult{NATType: NATTypeFullCone, ExternalIP: "27.1.1.2"}},
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.Equal(t, 1.0, res.Confidence, "should match")
+		assert.Equal(t, []string{
+			"externalIP: 27.1.1.1 (a), 27.1.1.2 (b); different external IPs imply address pooling",
+		}, res.Disagreements, "should match")
+	})
+
+	t.Run("All failed", func(t *testing.T) {
+		_, err := mergeResults([]*ServerResult{
+			{Server: "a", Error: "timed out", Err: &TimeoutError{Op: "discovery"}},
+			{Server: "b", Error: "timed out", Err: &TimeoutError{Op: "discovery"}},
+		})
+		if !assert.Error(t, err, "should fail") {
+			return
+		}
+		assert.Equal(t, "all servers failed: a: timed out, b: timed out", err.Error(), "should match")
+
+		var terr *TimeoutError
+		assert.True(t, errors.As(err, &terr), "should be a TimeoutError")
+	})
+}
@@ -0,0 +1,37 @@
+package nats
+
+// Observer is notified of the progress of discoveries, e.g. to show it to
+// the user. The methods are called from the goroutines running the
+// discovery, possibly concurrently, and must return promptly.
+type Observer interface {
+	// OnProbeSent is called when a request is sent, before any
+	// retransmission. Only the fields known by then are set.
+	OnProbeSent(p *ProbeTrace)
+	// OnResponseReceived is called when the response to a request arrives,
+	// with the fields about it set.
+	OnResponseReceived(p *ProbeTrace)
+	// OnPhaseCompleted is called when a phase of a discovery completes,
+	// such as "mapping behavior discovery", "filtering behavior discovery",
+	// "hairpinning discovery", "port allocation analysis", "classic
+	// discovery", "TCP mapping behavior discovery", "binding lifetime
+	// discovery" or "probe". When the discovery fails, it is called once
+	// with the phase that failed, if known, and the error.
+	OnPhaseCompleted(phase string, err error)
+}
+
+// Notifies the observer, if any, that the phase completed. On failure, the
+// phase is taken from err if it tells.
+func (nats *NATS) phaseCompleted(phase string, err error) {
+	if nats.observer == nil {
+		return
+	}
+
+	switch e := err.(type) {
+	case *DiscoveryError:
+		phase = e.Op
+	case *TimeoutError:
+		phase = e.Op
+	}
+
+	nats.observer.OnPhaseCompleted(phase, err)
+}
@@ -0,0 +1,177 @@
+package nats
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+type phaseEvent struct {
+	phase string
+	err   error
+}
+
+type recordingObserver struct {
+	mutex    sync.Mutex
+	sent     []*ProbeTrace
+	received []*ProbeTrace
+	phases   []phaseEvent
+}
+
+func (o *recordingObserver) OnProbeSent(p *ProbeTrace) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.sent = append(o.sent, p)
+}
+
+func (o *recordingObserver) OnResponseReceived(p *ProbeTrace) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.received = append(o.received, p)
+}
+
+func (o *recordingObserver) OnPhaseCompleted(phase string, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.phases = append(o.phases, phaseEvent{phase: phase, err: err})
+}
+
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestObserver(t *testing.T) {
+	natType := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
+	}
+
+	t.Run("Discover", func(t *testing.T) {
+		v, err := buildVNet(natType)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		observer := &recordingObserver{}
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 300 * time.Millisecond,
+			Observer:           observer,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer nats.Close() // nolint:errcheck,gosec
+
+		_, err = nats.Discover()
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		// 4 for the mapping, 2 for the filtering and 2 for hairpinning, of
+		// which the filtering ones and the hairpinning one are not answered.
+		assert.Equal(t, 8, len(observer.sent), "should match")
+		assert.Equal(t, 5, len(observer.received), "should match")
+		for _, p := range observer.sent {
+			assert.Empty(t, p.Outcome, "should not be known yet")
+		}
+		for _, p := range observer.received {
+			assert.Equal(t, "success", p.Outcome, "should match")
+		}
+
+		assert.Equal(t, []phaseEvent{
+			{phase: "mapping behavior discovery"},
+			{phase: "filtering behavior discovery"},
+			{phase: "hairpinning discovery"},
+		}, observer.phases, "should match")
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		v, err := buildVNet(natType)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+			return false
+		})
+
+		observer := &recordingObserver{}
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 300 * time.Millisecond,
+			Observer:           observer,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer nats.Close() // nolint:errcheck,gosec
+
+		_, err = nats.Discover()
+		assert.True(t, errors.Is(err, ErrUDPBlocked), "should fail")
+
+		observer.mutex.Lock()
+		defer observer.mutex.Unlock()
+		if assert.Equal(t, 1, len(observer.phases), "should match") {
+			assert.Equal(t, "mapping behavior discovery", observer.phases[0].phase, "should match")
+			assert.Equal(t, err, observer.phases[0].err, "should match")
+		}
+		assert.Empty(t, observer.received, "should not receive any")
+	})
+
+	t.Run("LoggerFactory", func(t *testing.T) {
+		v, err := buildVNet(natType)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		buf := &syncBuffer{}
+		loggerFactory := logging.NewDefaultLoggerFactory()
+		loggerFactory.Writer = buf
+		loggerFactory.ScopeLevels["nats"] = logging.LogLevelDebug
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 300 * time.Millisecond,
+			LoggerFactory:      loggerFactory,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer nats.Close() // nolint:errcheck,gosec
+
+		_, err = nats.Discover()
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.True(t, strings.Contains(buf.String(), "nats DEBUG: "), "should be logged")
+		assert.True(t, strings.Contains(buf.String(), "MAPPED-ADDRESS [0]: 27.1.1.1:"), "should be logged")
+	})
+}
@@ -0,0 +1,158 @@
+package nats
+
+import (
+	"context"
+	"net"
+
+	"github.com/pion/stun"
+)
+
+// PortAllocationPattern describes how a NAT picks the port of a new mapping.
+type PortAllocationPattern uint8
+
+const (
+	// PortAllocationUndefined means there were too few mappings to tell
+	PortAllocationUndefined PortAllocationPattern = iota
+	// PortAllocationPreserved means the mapped port is the local port
+	PortAllocationPreserved
+	// PortAllocationSequential means the mapped port increases by a fixed delta
+	PortAllocationSequential
+	// PortAllocationRandom means no pattern was found
+	PortAllocationRandom
+)
+
+func (p PortAllocationPattern) String() string {
+	switch p {
+	case PortAllocationPreserved:
+		return "preserved"
+	case PortAllocationSequential:
+		return "sequential"
+	case PortAllocationRandom:
+		return "random"
+	}
+	return "unspecified"
+}
+
+// PortAllocation contains the result of the port allocation analysis, which
+// Discover runs when Config.PortAllocationProbes is set and the mapping
+// behavior is endpoint dependent.
+type PortAllocation struct {
+	Pattern PortAllocationPattern `json:"pattern"`
+	// Delta between the ports of consecutive mappings. (sequential only)
+	Delta int `json:"delta"`
+	// Port the next mapping is expected to get. (sequential only)
+	PredictedPort int `json:"predictedPort"`
+	// Mapped ports in the order the mappings were created
+	MappedPorts []int `json:"mappedPorts"`
+}
+
+// Ratio of deltas that must agree for the allocation to be sequential. Some
+// tolerance is needed as other hosts behind the NAT create mappings too.
+const sequentialRatio = 2.0 / 3.0
+
+type portSample struct {
+	localPort  int
+	mappedPort int
+}
+
+// Opens n sockets, each sending a Binding request to every address of the
+// server, and analyzes the mapped ports of the mappings created.
+func (nats *NATS) discoverPortAllocation(ctx context.Context, toAddrs [4]*net.UDPAddr, n int) (*PortAllocation, error) {
+	var samples []portSample
+
+	for i := 0; i < n; i++ {
+		conn, err := nats.listenPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		locPort := conn.LocalAddr().(*net.UDPAddr).Port
+		seen := map[int]bool{}
+
+		for j, to := range toAddrs {
+			msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			trRes, err := nats.roundTrip(ctx, conn, msg, to, "port allocation analysis")
+			if err != nil {
+				conn.Close()
+				if ctx.Err() != nil {
+					return nil, contextError(ctx, "port allocation analysis")
+				}
+				return nil, nats.probeError("port allocation analysis", i*len(toAddrs)+j, to, err)
+			}
+
+			var maddr stun.XORMappedAddress
+			if err = maddr.GetFrom(trRes.msg); err != nil {
+				conn.Close()
+				return nil, nats.probeError("port allocation analysis", i*len(toAddrs)+j, to, errNoXORMappedAddress)
+			}
+
+			// An address dependent mapping is shared by both ports
+			if seen[maddr.Port] {
+				continue
+			}
+			seen[maddr.Port] = true
+			samples = append(samples, portSample{localPort: locPort, mappedPort: maddr.Port})
+		}
+
+		conn.Close()
+	}
+
+	pa := analyzePortAllocation(samples)
+	nats.log.Debugf("port allocation: %s delta=%d ports=%v", pa.Pattern, pa.Delta, pa.MappedPorts)
+
+	return pa, nil
+}
+
+// Finds the allocation pattern from the samples ordered by creation time.
+func analyzePortAllocation(samples []portSample) *PortAllocation {
+	pa := &PortAllocation{}
+	for _, s := range samples {
+		pa.MappedPorts = append(pa.MappedPorts, s.mappedPort)
+	}
+
+	if len(samples) < 2 {
+		return pa
+	}
+
+	preserved := true
+	for _, s := range samples {
+		if s.mappedPort != s.localPort {
+			preserved = false
+			break
+		}
+	}
+	if preserved {
+		pa.Pattern = PortAllocationPreserved
+		return pa
+	}
+
+	// Find the most frequent delta
+	counts := map[int]int{}
+	mode, modeCount := 0, 0
+	for i := 1; i < len(samples); i++ {
+		d := samples[i].mappedPort - samples[i-1].mappedPort
+		counts[d]++
+		if counts[d] > modeCount {
+			mode, modeCount = d, counts[d]
+		}
+	}
+
+	nDeltas := len(samples) - 1
+	if mode != 0 && float64(modeCount) >= sequentialRatio*float64(nDeltas) {
+		pa.Pattern = PortAllocationSequential
+		pa.Delta = mode
+		pa.PredictedPort = samples[len(samples)-1].mappedPort + mode
+		if pa.PredictedPort < 1 || pa.PredictedPort > 0xffff {
+			pa.PredictedPort = 0
+		}
+		return pa
+	}
+
+	pa.Pattern = PortAllocationRandom
+	return pa
+}
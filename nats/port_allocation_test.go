@@ -0,0 +1,119 @@
+package nats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortAllocationOnVNet(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mapping  vnet.EndpointDependencyType
+		expected int // number of mappings expected
+	}{
+		{"Address-port dependent mapping", vnet.EndpointAddrPortDependent, 12},
+		{"Address dependent mapping", vnet.EndpointAddrDependent, 6},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := buildVNet(&vnet.NATType{
+				MappingBehavior:   tc.mapping,
+				FilteringBehavior: vnet.EndpointAddrPortDependent,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+
+			nats, err := NewNATS(&Config{
+				Server:               "stun.pion.net:3478",
+				Net:                  v.net0,
+				TransactionTimeout:   500 * time.Millisecond,
+				PortAllocationProbes: 3,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			res, err := nats.Discover()
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			pa := res.PortAllocation
+			if !assert.NotNil(t, pa, "should be analyzed") {
+				return
+			}
+
+			// vnet allocates ports sequentially
+			assert.Equal(t, PortAllocationSequential, pa.Pattern, "should match")
+			assert.Equal(t, 1, pa.Delta, "should match")
+			assert.Equal(t, tc.expected, len(pa.MappedPorts), "should match")
+			assert.Equal(t, pa.MappedPorts[len(pa.MappedPorts)-1]+1, pa.PredictedPort, "should match")
+		})
+	}
+
+	t.Run("Endpoint independent mapping", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:               "stun.pion.net:3478",
+			Net:                  v.net0,
+			PortAllocationProbes: 3,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		res, err := nats.Discover()
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.Nil(t, res.PortAllocation, "should not be analyzed")
+	})
+}
+
+func TestAnalyzePortAllocation(t *testing.T) {
+	t.Run("Preserved", func(t *testing.T) {
+		pa := analyzePortAllocation([]portSample{{5000, 5000}, {5001, 5001}, {5002, 5002}})
+		assert.Equal(t, PortAllocationPreserved, pa.Pattern, "should match")
+		assert.Equal(t, 0, pa.PredictedPort, "should match")
+	})
+
+	t.Run("Sequential with other hosts' mappings", func(t *testing.T) {
+		pa := analyzePortAllocation([]portSample{
+			{5000, 40000}, {5000, 40002}, {5000, 40004}, {5001, 40010},
+			{5001, 40012}, {5001, 40014}, {5002, 40016},
+		})
+		assert.Equal(t, PortAllocationSequential, pa.Pattern, "should match")
+		assert.Equal(t, 2, pa.Delta, "should match")
+		assert.Equal(t, 40018, pa.PredictedPort, "should match")
+	})
+
+	t.Run("Random", func(t *testing.T) {
+		pa := analyzePortAllocation([]portSample{
+			{5000, 40000}, {5000, 13513}, {5000, 61009}, {5001, 24301}, {5001, 50122},
+		})
+		assert.Equal(t, PortAllocationRandom, pa.Pattern, "should match")
+		assert.Equal(t, 0, pa.PredictedPort, "should match")
+	})
+
+	t.Run("Too few mappings", func(t *testing.T) {
+		pa := analyzePortAllocation([]portSample{{5000, 40000}})
+		assert.Equal(t, PortAllocationUndefined, pa.Pattern, "should match")
+		assert.Equal(t, []int{40000}, pa.MappedPorts, "should match")
+	})
+}
@@ -0,0 +1,261 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/stun"
+)
+
+// Length of PADDING sent to see if the server echoes it
+const probePaddingLength = 512
+
+// Pads requests with RESPONSE-PORT, which servers may not answer with a
+// larger response, as PADDING is not allowed along with it. (RFC 5780
+// Section 6.1)
+var responsePortPadding = stun.NewSoftware("go-nats" + strings.Repeat(" ", 120))
+
+// ProbeResult tells which of the features used for NAT behavior discovery a
+// STUN server supports.
+//
+// CHANGE-REQUEST and RESPONSE-PORT are checked by whether the response comes
+// back as requested. Before each CHANGE-REQUEST, a Binding request is sent to
+// the address the response is to come from, so that a NAT filtering inbound
+// packets lets it in. Behind a NAT whose mapping is endpoint dependent, they
+// may still be reported as unsupported even if the server supports them.
+type ProbeResult struct {
+	Server           string `json:"server"`
+	XORMappedAddress bool   `json:"xorMappedAddress"`
+	OtherAddress     bool   `json:"otherAddress"`
+	ChangedAddress   bool   `json:"changedAddress"`
+	ChangeIP         bool   `json:"changeIP"`
+	ChangePort       bool   `json:"changePort"`
+	ResponseOrigin   bool   `json:"responseOrigin"`
+	ResponsePort     bool   `json:"responsePort"`
+	Padding          bool   `json:"padding"`
+	Fingerprint      bool   `json:"fingerprint"`
+}
+
+// SupportsRFC5780 tells whether the server supports what the RFC 5780
+// discovery needs.
+func (r *ProbeResult) SupportsRFC5780() bool {
+	return r.XORMappedAddress &&
+		(r.OtherAddress || r.ChangedAddress) &&
+		r.ChangeIP &&
+		r.ChangePort
+}
+
+// ProbeServer checks which features the STUN server at addr supports.
+func ProbeServer(addr string) (*ProbeResult, error) {
+	nats, err := NewNATS(&Config{Server: addr})
+	if err != nil {
+		return nil, err
+	}
+	defer nats.Close()
+
+	return nats.Probe(context.Background())
+}
+
+// Probe checks which features the server supports. Only one server must be
+// configured.
+func (nats *NATS) Probe(ctx context.Context) (*ProbeResult, error) {
+	if nats.serverAddr == nil {
+		return nil, fmt.Errorf("probing requires a single server")
+	}
+
+	ctx, cancel, err := nats.res.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	res, err := nats.probe(ctx)
+	nats.phaseCompleted("probe", err)
+	return res, err
+}
+
+// Probes the server as Probe does.
+func (nats *NATS) probe(ctx context.Context) (*ProbeResult, error) {
+	if nats.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nats.timeout)
+		defer cancel()
+	}
+
+	connX, err := nats.listenPacket()
+	if err != nil {
+		return nil, err
+	}
+	defer connX.Close()
+
+	connY, err := nats.listenPacket()
+	if err != nil {
+		return nil, err
+	}
+	defer connY.Close()
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	trRes, err := nats.roundTrip(ctx, connX, msg, nats.serverAddr, "probe")
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, contextError(ctx, "probe")
+		}
+		return nil, nats.probeError("probe", 0, nats.serverAddr, err)
+	}
+
+	if trRes.msg.Type.Class != stun.ClassSuccessResponse {
+		return nil, nats.probeError("probe", 0, nats.serverAddr, &kindError{ErrMalformedResponse,
+			fmt.Errorf("unexpected response: %s", trRes.msg.Type.String())})
+	}
+
+	res := &ProbeResult{Server: nats.server}
+
+	var xorAddr stun.XORMappedAddress
+	res.XORMappedAddress = xorAddr.GetFrom(trRes.msg) == nil
+	res.OtherAddress = trRes.msg.Contains(attr.TypeOtherAddress)
+	res.ChangedAddress = trRes.msg.Contains(attr.TypeChangedAddress)
+	res.ResponseOrigin = trRes.msg.Contains(attr.TypeResponseOrigin)
+	res.Fingerprint = stun.Fingerprint.Check(trRes.msg) == nil
+
+	mappedAddr, err := getMappedAddress(trRes.msg)
+	if err != nil {
+		return nil, nats.probeError("probe", 0, nats.serverAddr, err)
+	}
+
+	otherAddr, _, _ := getOtherAddress(trRes.msg) // nil if not given
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	go func() {
+		defer wg.Done()
+		res.ChangeIP = nats.probeChangeRequest(ctx, otherAddr, true, false)
+	}()
+
+	go func() {
+		defer wg.Done()
+		res.ChangePort = nats.probeChangeRequest(ctx, otherAddr, false, true)
+	}()
+
+	go func() {
+		defer wg.Done()
+		res.ResponsePort = nats.probeResponsePort(ctx, connY, connX, mappedAddr.Port)
+	}()
+
+	go func() {
+		defer wg.Done()
+		res.Padding = nats.probePadding(ctx)
+	}()
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, contextError(ctx, "probe")
+	}
+
+	return res, nil
+}
+
+// Tells whether the response to CHANGE-REQUEST came from the address
+// requested. otherAddr is the alternate address of the server, if known.
+func (nats *NATS) probeChangeRequest(ctx context.Context, otherAddr *attr.Address, changeIP, changePort bool) bool {
+	conn, err := nats.listenPacket()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	// Open the filter of the NAT, if any, toward the address the response is
+	// to come from. The response to this request is discarded as stray.
+	if otherAddr != nil {
+		from := &net.UDPAddr{IP: nats.serverAddr.IP, Port: nats.serverAddr.Port}
+		if changeIP {
+			from.IP = otherAddr.IP
+		}
+		if changePort {
+			from.Port = otherAddr.Port
+		}
+
+		opener, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+		if err != nil {
+			return false
+		}
+		if _, err = conn.WriteTo(opener.Raw, from); err != nil {
+			return false
+		}
+	}
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+		&attr.ChangeRequest{ChangeIP: changeIP, ChangePort: changePort})
+	if err != nil {
+		return false
+	}
+
+	trRes, err := nats.roundTrip(ctx, conn, msg, nats.serverAddr, "probe")
+	if err != nil {
+		nats.log.Debugf("CHANGE-REQUEST (changeIP=%v changePort=%v): %s",
+			changeIP, changePort, err.Error())
+		return false
+	}
+	if trRes.msg.Type.Class != stun.ClassSuccessResponse {
+		return false
+	}
+
+	from := trRes.from.(*net.UDPAddr)
+	nats.log.Debugf("CHANGE-REQUEST (changeIP=%v changePort=%v): response from %s",
+		changeIP, changePort, from.String())
+
+	ipChanged := !from.IP.Equal(nats.serverAddr.IP)
+	portChanged := from.Port != nats.serverAddr.Port
+	return ipChanged == changeIP && portChanged == changePort
+}
+
+// Tells whether the response to a request sent from sendConn arrives on
+// recvConn, whose mapped port is port.
+func (nats *NATS) probeResponsePort(ctx context.Context, sendConn, recvConn net.PacketConn, port int) bool {
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+		&attr.ResponsePort{Port: port}, responsePortPadding)
+	if err != nil {
+		return false
+	}
+
+	trRes, err := nats.roundTripVia(ctx, sendConn, recvConn, msg, nats.serverAddr, "probe")
+	if err != nil {
+		nats.log.Debugf("RESPONSE-PORT: %s", err.Error())
+		return false
+	}
+
+	return trRes.msg.Type.Class == stun.ClassSuccessResponse
+}
+
+// Tells whether the server pads the response when the request has PADDING.
+func (nats *NATS) probePadding(ctx context.Context) bool {
+	conn, err := nats.listenPacket()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+		&attr.Padding{Length: probePaddingLength})
+	if err != nil {
+		return false
+	}
+
+	trRes, err := nats.roundTrip(ctx, conn, msg, nats.serverAddr, "probe")
+	if err != nil {
+		nats.log.Debugf("PADDING: %s", err.Error())
+		return false
+	}
+
+	return trRes.msg.Type.Class == stun.ClassSuccessResponse &&
+		trRes.msg.Contains(attr.TypePadding)
+}
@@ -0,0 +1,151 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/enobufs/go-nats/server"
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe(t *testing.T) {
+	natType := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+
+	t.Run("RFC 5780 server", func(t *testing.T) {
+		v, err := buildVNetWithServer(natType, func(config *server.Config) {
+			config.AlternateAddressAttrs = []stun.AttrType{server.AttrTypeOtherAddress}
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server: "stun.pion.net:3478",
+			Net:    v.net0,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		res, err := nats.Probe(context.Background())
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.Equal(t, "stun.pion.net:3478", res.Server, "should match")
+		assert.True(t, res.XORMappedAddress, "should be supported")
+		assert.True(t, res.OtherAddress, "should be supported")
+		assert.False(t, res.ChangedAddress, "should not be supported")
+		assert.True(t, res.ChangeIP, "should be supported")
+		assert.True(t, res.ChangePort, "should be supported")
+		assert.True(t, res.ResponseOrigin, "should be supported")
+		assert.True(t, res.ResponsePort, "should be supported")
+		assert.True(t, res.Padding, "should be supported")
+		assert.True(t, res.Fingerprint, "should be supported")
+		assert.True(t, res.SupportsRFC5780(), "should be supported")
+	})
+
+	t.Run("Behind port-restricted cone NAT", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointAddrPortDependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 300 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		res, err := nats.Probe(context.Background())
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.True(t, res.ChangeIP, "should be supported")
+		assert.True(t, res.ChangePort, "should be supported")
+		assert.True(t, res.ResponsePort, "should be supported")
+		assert.True(t, res.SupportsRFC5780(), "should be supported")
+	})
+
+	t.Run("RFC 3489 server", func(t *testing.T) {
+		v, err := buildVNetWithServer(natType, func(config *server.Config) {
+			config.LegacyMappedAddress = true
+			config.IgnoreChangeRequest = true
+			config.AlternateAddressAttrs = []stun.AttrType{server.AttrTypeChangedAddress}
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 300 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		res, err := nats.Probe(context.Background())
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.False(t, res.XORMappedAddress, "should not be supported")
+		assert.False(t, res.OtherAddress, "should not be supported")
+		assert.True(t, res.ChangedAddress, "should be supported")
+		assert.False(t, res.ChangeIP, "should not be supported")
+		assert.False(t, res.ChangePort, "should not be supported")
+		assert.False(t, res.ResponseOrigin, "should not be supported")
+		assert.False(t, res.SupportsRFC5780(), "should not be supported")
+	})
+
+	t.Run("Unreachable server", func(t *testing.T) {
+		v, err := buildVNet(natType)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "1.2.3.99:3478",
+			Net:                v.net0,
+			TransactionTimeout: 300 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		_, err = nats.Probe(context.Background())
+		assert.True(t, errors.Is(err, ErrUDPBlocked), "should fail")
+	})
+
+	t.Run("Multiple servers", func(t *testing.T) {
+		nats, err := NewNATS(&Config{
+			Servers: []string{"1.2.3.4:3478", "1.2.3.6:3478"},
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		_, err = nats.Probe(context.Background())
+		assert.Error(t, err, "should fail")
+	})
+}
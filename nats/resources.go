@@ -0,0 +1,135 @@
+package nats
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/pion/turn"
+)
+
+// stunClient is a socket along with the turn.Client listening on it.
+type stunClient struct {
+	conn   net.PacketConn
+	client *turn.Client
+}
+
+func (c *stunClient) close() {
+	c.client.Close()
+	c.conn.Close()
+}
+
+// resources holds what a NATS instance keeps across discoveries: an idle
+// client per network to reuse for the mapping behavior discovery, and the
+// means to abort the discoveries in progress on Close. It is shared by the
+// copies of the instance made for other servers and networks.
+type resources struct {
+	mutex   sync.Mutex
+	clients map[string]*stunClient // idle ones by network
+	closed  bool
+	done    chan struct{} // closed on Close
+}
+
+func newResources() *resources {
+	return &resources{
+		clients: map[string]*stunClient{},
+		done:    make(chan struct{}),
+	}
+}
+
+// Returns a context derived from ctx that is also canceled on Close. The
+// returned cancel function must be called once done with it.
+func (r *resources) start(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	r.mutex.Lock()
+	closed := r.closed
+	r.mutex.Unlock()
+	if closed {
+		return nil, nil, ErrClosed
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel, nil
+}
+
+// Takes the idle client for the network, if any.
+func (r *resources) acquire(network string) *stunClient {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	c := r.clients[network]
+	delete(r.clients, network)
+	return c
+}
+
+// Keeps the client for the next discovery unless another one is kept
+// already or the instance is closed, in which case the client is closed.
+func (r *resources) release(network string, c *stunClient) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed || r.clients[network] != nil {
+		c.close()
+		return
+	}
+	r.clients[network] = c
+}
+
+func (r *resources) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.done)
+
+	for network, c := range r.clients {
+		c.close()
+		delete(r.clients, network)
+	}
+}
+
+// Opens a socket with a turn.Client listening on it.
+func (nats *NATS) newSTUNClient() (*stunClient, error) {
+	conn, err := nats.listenPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	// STUNServerAddr is left empty as turn.Client only resolves IPv4
+	// addresses. The server address is given to each transaction instead.
+	c, err := turn.NewClient(&turn.ClientConfig{
+		Conn:          conn,
+		LoggerFactory: nats.loggerFactory,
+		Net:           nats.net,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err = c.Listen(); err != nil {
+		c.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	return &stunClient{conn: conn, client: c}, nil
+}
+
+// Close releases the sockets kept for reuse, and aborts the discoveries in
+// progress, which return context.Canceled. Further discoveries return
+// ErrClosed.
+func (nats *NATS) Close() error {
+	nats.res.close()
+	return nil
+}
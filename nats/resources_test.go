@@ -0,0 +1,120 @@
+package nats
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClose(t *testing.T) {
+	natType := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
+	}
+
+	t.Run("Discover after Close", func(t *testing.T) {
+		v, err := buildVNet(natType)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		nats, err := NewNATS(&Config{
+			Server:             "stun.pion.net:3478",
+			Net:                v.net0,
+			TransactionTimeout: 500 * time.Millisecond,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		_, err = nats.Discover()
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.NotNil(t, nats.res.clients["udp4"], "should keep the client")
+
+		assert.NoError(t, nats.Close(), "should succeed")
+		assert.Empty(t, nats.res.clients, "should close the client")
+		assert.NoError(t, nats.Close(), "should be idempotent")
+
+		_, err = nats.Discover()
+		assert.Equal(t, ErrClosed, err, "should be closed")
+		_, err = nats.Probe(context.Background())
+		assert.Equal(t, ErrClosed, err, "should be closed")
+	})
+
+	t.Run("Close aborts discovery", func(t *testing.T) {
+		v, err := buildVNet(natType)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		// Server never responds
+		v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+			return false
+		})
+
+		nats, err := NewNATS(&Config{
+			Server: "stun.pion.net:3478",
+			Net:    v.net0,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		time.AfterFunc(200*time.Millisecond, func() {
+			nats.Close() // nolint:errcheck,gosec
+		})
+
+		start := time.Now()
+		_, err = nats.Discover()
+		assert.True(t, time.Since(start) < time.Second, "should return promptly")
+		assert.Equal(t, context.Canceled, err, "should be canceled")
+	})
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	v, err := buildVNet(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointAddrPortDependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	nats, err := NewNATS(&Config{
+		Server:               "stun.pion.net:3478",
+		Net:                  v.net0,
+		TransactionTimeout:   500 * time.Millisecond,
+		PortAllocationProbes: 2,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		res, err := nats.Discover()
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.Equal(t, NATTypeSymmetric, res.NATType, "should match")
+	}
+
+	assert.NoError(t, nats.Close(), "should succeed")
+
+	// Give the goroutines closed along a moment to exit
+	deadline := time.Now().Add(3 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before, "should not leak goroutines")
+}
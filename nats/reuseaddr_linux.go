@@ -0,0 +1,18 @@
+package nats
+
+import (
+	"syscall"
+)
+
+// Lets sockets share the local port, which all of them must allow. Unlike
+// BSD, SO_REUSEADDR is enough on Linux as none of the sockets listens.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
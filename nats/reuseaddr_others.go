@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package nats
+
+import (
+	"syscall"
+)
+
+// Sharing the local port is not supported, hence the discovery over TCP fails
+// beyond the first connection.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package nats
+
+import (
+	"syscall"
+)
+
+// Lets sockets share the local port.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
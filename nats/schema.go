@@ -0,0 +1,243 @@
+package nats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// SchemaVersion is the version of the JSON encoding of DiscoverResult. It is
+// bumped whenever a field is renamed or its encoding changes. Results without
+// "schemaVersion" are of version 1, where the enums were encoded as numbers
+// and "natType" as the label returned by NATType.String.
+const SchemaVersion = 2
+
+// NATType is the classification of the NAT, or the lack of it, in front of
+// the client. The cone and symmetric names map the RFC 4787 behaviors onto the
+// classic RFC 3489 terms. RFC4787Name tells the behaviors instead.
+type NATType uint8
+
+const (
+	// NATTypeUndefined means the behaviors could not be told apart
+	NATTypeUndefined NATType = iota
+	// NATTypeOpenInternet means neither translated nor filtered
+	NATTypeOpenInternet
+	// NATTypeFullCone means endpoint-independent mapping and filtering
+	NATTypeFullCone
+	// NATTypeAddrRestrictedCone means endpoint-independent mapping and
+	// address-dependent filtering
+	NATTypeAddrRestrictedCone
+	// NATTypePortRestrictedCone means endpoint-independent mapping and
+	// address and port-dependent filtering
+	NATTypePortRestrictedCone
+	// NATTypeSymmetric means address (and port)-dependent mapping
+	NATTypeSymmetric
+	// NATTypeCone means endpoint-independent mapping with unknown filtering,
+	// found by AlgorithmRFC3489 when the server ignores CHANGE-REQUEST
+	NATTypeCone
+	// NATTypeNotNatted means not translated with unknown filtering, found by
+	// AlgorithmRFC3489 when the server ignores CHANGE-REQUEST
+	NATTypeNotNatted
+	// NATTypeSymmetricUDPFirewall means not translated but filtered, as
+	// found by AlgorithmRFC3489
+	NATTypeSymmetricUDPFirewall
+	// NATTypeStatefulFirewall means not translated but filtered, with udp6
+	NATTypeStatefulFirewall
+	// NATTypeUDPBlockedByFirewall means not translated but filtered, with udp4
+	NATTypeUDPBlockedByFirewall
+	// NATTypeUDPBlocked means no response was received at all
+	NATTypeUDPBlocked
+	// NATTypeNPTv6 means the IPv6 prefix is translated statelessly (RFC 6296)
+	NATTypeNPTv6
+)
+
+var natTypeNames = [...]struct {
+	text    string // used in JSON, and returned by String
+	rfc4787 string // returned by RFC4787Name
+	label   string // used in JSON before schema version 2
+}{
+	NATTypeUndefined: {"undefined", "undefined", "(undefined)"},
+	NATTypeOpenInternet: {"open-internet",
+		"no-translation/endpoint-independent-filtering", "Open to the Internet"},
+	NATTypeFullCone: {"full-cone",
+		"endpoint-independent-mapping/endpoint-independent-filtering", "Full cone NAT"},
+	NATTypeAddrRestrictedCone: {"address-restricted-cone",
+		"endpoint-independent-mapping/address-dependent-filtering", "Address-restricted cone NAT"},
+	NATTypePortRestrictedCone: {"port-restricted-cone",
+		"endpoint-independent-mapping/address-and-port-dependent-filtering", "Port-restricted cone NAT"},
+	NATTypeSymmetric: {"symmetric",
+		"endpoint-dependent-mapping", "Symmetric NAT"},
+	NATTypeCone: {"cone",
+		"endpoint-independent-mapping/unknown-filtering", "Cone NAT"},
+	NATTypeNotNatted: {"not-natted",
+		"no-translation/unknown-filtering", "Not natted"},
+	NATTypeSymmetricUDPFirewall: {"symmetric-udp-firewall",
+		"no-translation/endpoint-dependent-filtering", "Symmetric UDP firewall"},
+	NATTypeStatefulFirewall: {"stateful-firewall",
+		"no-translation/endpoint-dependent-filtering/ipv6", "Stateful firewall"},
+	NATTypeUDPBlockedByFirewall: {"udp-blocked-by-firewall",
+		"no-translation/endpoint-dependent-filtering/ipv4", "UDP blocked by firewall"},
+	NATTypeUDPBlocked: {"udp-blocked", "udp-blocked", "UDP blocked"},
+	NATTypeNPTv6:      {"nptv6", "stateless-prefix-translation", "NPTv6"},
+}
+
+func (t NATType) String() string {
+	if int(t) < len(natTypeNames) {
+		return natTypeNames[t].text
+	}
+	return "unspecified"
+}
+
+// RFC4787Name returns the name of the type in the terms of RFC 4787, such as
+// "endpoint-independent-mapping/address-dependent-filtering" for
+// NATTypeAddrRestrictedCone. Symmetric NATs are "endpoint-dependent-mapping",
+// whatever their filtering. The firewalls found with udp4 and udp6 by
+// AlgorithmRFC5780 are told apart by a suffix, and the types outside the
+// scope of RFC 4787 (undefined, udp-blocked and nptv6) are named after what
+// they are.
+func (t NATType) RFC4787Name() string {
+	if int(t) < len(natTypeNames) {
+		return natTypeNames[t].rfc4787
+	}
+	return "unspecified"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t NATType) MarshalText() ([]byte, error) {
+	if int(t) < len(natTypeNames) {
+		return []byte(natTypeNames[t].text), nil
+	}
+	return nil, fmt.Errorf("invalid NAT type %d", t)
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. The names returned by
+// RFC4787Name, and the labels written before schema version 2, are accepted
+// as well.
+func (t *NATType) UnmarshalText(text []byte) error {
+	for i, n := range natTypeNames {
+		if string(text) == n.text || string(text) == n.rfc4787 || string(text) == n.label {
+			*t = NATType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid NAT type %q", text)
+}
+
+var endpointDependencyTexts = [...]string{
+	EndpointIndependent:       "endpoint-independent",
+	EndpointAddrDependent:     "address-dependent",
+	EndpointAddrPortDependent: "address-and-port-dependent",
+	EndpointUndefined:         "undefined",
+}
+
+// RFC4787Name returns the behavior in the terms of RFC 4787, as encoded in
+// JSON, such as "address-dependent".
+func (t EndpointDependencyType) RFC4787Name() string {
+	return enumString(endpointDependencyTexts[:], uint8(t))
+}
+
+// MarshalText implements encoding.TextMarshaler, with the RFC 4787 terms.
+func (t EndpointDependencyType) MarshalText() ([]byte, error) {
+	return marshalEnum(endpointDependencyTexts[:], uint8(t), "endpoint dependency type")
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *EndpointDependencyType) UnmarshalText(text []byte) error {
+	return unmarshalEnum(endpointDependencyTexts[:], text, (*uint8)(t), "endpoint dependency type")
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Numbers, as written before
+// schema version 2, are accepted as well.
+func (t *EndpointDependencyType) UnmarshalJSON(data []byte) error {
+	return unmarshalEnumJSON(endpointDependencyTexts[:], data, (*uint8)(t), "endpoint dependency type")
+}
+
+var translationTexts = [...]string{
+	TranslationNone:  "none",
+	TranslationNAT:   "nat",
+	TranslationNPTv6: "nptv6",
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t TranslationType) MarshalText() ([]byte, error) {
+	return marshalEnum(translationTexts[:], uint8(t), "translation type")
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *TranslationType) UnmarshalText(text []byte) error {
+	return unmarshalEnum(translationTexts[:], text, (*uint8)(t), "translation type")
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Numbers, as written before
+// schema version 2, are accepted as well.
+func (t *TranslationType) UnmarshalJSON(data []byte) error {
+	return unmarshalEnumJSON(translationTexts[:], data, (*uint8)(t), "translation type")
+}
+
+var portAllocationTexts = [...]string{
+	PortAllocationUndefined:  "undefined",
+	PortAllocationPreserved:  "preserved",
+	PortAllocationSequential: "sequential",
+	PortAllocationRandom:     "random",
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (p PortAllocationPattern) MarshalText() ([]byte, error) {
+	return marshalEnum(portAllocationTexts[:], uint8(p), "port allocation pattern")
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *PortAllocationPattern) UnmarshalText(text []byte) error {
+	return unmarshalEnum(portAllocationTexts[:], text, (*uint8)(p), "port allocation pattern")
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Numbers, as written before
+// schema version 2, are accepted as well.
+func (p *PortAllocationPattern) UnmarshalJSON(data []byte) error {
+	return unmarshalEnumJSON(portAllocationTexts[:], data, (*uint8)(p), "port allocation pattern")
+}
+
+// Returns the text of the value, as encoded by marshalEnum.
+func enumString(texts []string, v uint8) string {
+	if int(v) < len(texts) {
+		return texts[v]
+	}
+	return "unspecified"
+}
+
+func marshalEnum(texts []string, v uint8, name string) ([]byte, error) {
+	if int(v) < len(texts) {
+		return []byte(texts[v]), nil
+	}
+	return nil, fmt.Errorf("invalid %s %d", name, v)
+}
+
+func unmarshalEnum(texts []string, text []byte, v *uint8, name string) error {
+	for i, t := range texts {
+		if string(text) == t {
+			*v = uint8(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s %q", name, text)
+}
+
+func unmarshalEnumJSON(texts []string, data []byte, v *uint8, name string) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		return unmarshalEnum(texts, []byte(text), v, name)
+	}
+	n, err := strconv.ParseUint(string(data), 10, 8)
+	if err != nil || int(n) >= len(texts) {
+		return fmt.Errorf("invalid %s %s", name, data)
+	}
+	*v = uint8(n)
+	return nil
+}
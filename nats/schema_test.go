@@ -0,0 +1,164 @@
+package nats
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchema(t *testing.T) {
+	t.Run("Round trip", func(t *testing.T) {
+		res := &DiscoverResult{
+			SchemaVersion:     SchemaVersion,
+			IsNatted:          true,
+			MappingBehavior:   EndpointAddrPortDependent,
+			FilteringBehavior: EndpointAddrDependent,
+			NATType:           NATTypeSymmetric,
+			ExternalIP:        "27.1.1.1",
+			Network:           "udp4",
+			Translation:       TranslationNAT,
+			Algorithm:         AlgorithmRFC5780,
+			PortAllocation: &PortAllocation{
+				Pattern:     PortAllocationSequential,
+				Delta:       2,
+				MappedPorts: []int{5000, 5002},
+			},
+			TCP: &TCPResult{MappingBehavior: EndpointUndefined},
+		}
+
+		data, err := json.Marshal(res)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		var m map[string]interface{}
+		assert.NoError(t, json.Unmarshal(data, &m), "should succeed")
+		assert.Equal(t, float64(SchemaVersion), m["schemaVersion"], "should match")
+		assert.Equal(t, "address-and-port-dependent", m["mappingBehavior"], "should match")
+		assert.Equal(t, "address-dependent", m["filteringBehavior"], "should match")
+		assert.Equal(t, "symmetric", m["natType"], "should match")
+		assert.Equal(t, "nat", m["translation"], "should match")
+		assert.Equal(t, "sequential", m["portAllocation"].(map[string]interface{})["pattern"], "should match")
+		assert.Equal(t, "undefined", m["tcp"].(map[string]interface{})["mappingBehavior"], "should match")
+
+		var decoded DiscoverResult
+		assert.NoError(t, json.Unmarshal(data, &decoded), "should succeed")
+		assert.Equal(t, res, &decoded, "should match")
+	})
+
+	t.Run("Every value", func(t *testing.T) {
+		for i := range natTypeNames {
+			natType := NATType(i)
+			data, err := json.Marshal(natType)
+			assert.NoError(t, err, "should succeed")
+			assert.Equal(t, `"`+natType.String()+`"`, string(data), "should match String")
+			var decoded NATType
+			assert.NoError(t, json.Unmarshal(data, &decoded), "should succeed")
+			assert.Equal(t, natType, decoded, "should match")
+		}
+		for i := range endpointDependencyTexts {
+			behavior := EndpointDependencyType(i)
+			data, err := json.Marshal(behavior)
+			assert.NoError(t, err, "should succeed")
+			assert.Equal(t, `"`+behavior.RFC4787Name()+`"`, string(data), "should match RFC4787Name")
+			var decoded EndpointDependencyType
+			assert.NoError(t, json.Unmarshal(data, &decoded), "should succeed")
+			assert.Equal(t, behavior, decoded, "should match")
+		}
+		for i := range translationTexts {
+			translation := TranslationType(i)
+			data, err := json.Marshal(translation)
+			assert.NoError(t, err, "should succeed")
+			var decoded TranslationType
+			assert.NoError(t, json.Unmarshal(data, &decoded), "should succeed")
+			assert.Equal(t, translation, decoded, "should match")
+		}
+		for i := range portAllocationTexts {
+			pattern := PortAllocationPattern(i)
+			data, err := json.Marshal(pattern)
+			assert.NoError(t, err, "should succeed")
+			var decoded PortAllocationPattern
+			assert.NoError(t, json.Unmarshal(data, &decoded), "should succeed")
+			assert.Equal(t, pattern, decoded, "should match")
+		}
+	})
+
+	t.Run("String", func(t *testing.T) {
+		// Unchanged since before schema version 2
+		assert.Equal(t, "address dependent", EndpointAddrDependent.String(), "should match")
+		assert.Equal(t, "unspecified", EndpointUndefined.String(), "should match")
+		assert.Equal(t, "address-dependent", EndpointAddrDependent.RFC4787Name(), "should match")
+		assert.Equal(t, "undefined", EndpointUndefined.RFC4787Name(), "should match")
+	})
+
+	t.Run("RFC 4787 names", func(t *testing.T) {
+		assert.Equal(t, "endpoint-independent-mapping/address-dependent-filtering",
+			NATTypeAddrRestrictedCone.RFC4787Name(), "should match")
+		assert.Equal(t, "endpoint-dependent-mapping", NATTypeSymmetric.RFC4787Name(), "should match")
+
+		seen := map[string]NATType{}
+		for i := range natTypeNames {
+			natType := NATType(i)
+			name := natType.RFC4787Name()
+			if prev, ok := seen[name]; ok {
+				t.Errorf("%s and %s share the name %q", prev, natType, name)
+			}
+			seen[name] = natType
+
+			var decoded NATType
+			assert.NoError(t, decoded.UnmarshalText([]byte(name)), "should succeed")
+			assert.Equal(t, natType, decoded, "should match")
+
+			// Written as the classic name
+			data, err := json.Marshal(struct {
+				NATType NATType `json:"natType"`
+			}{decoded})
+			assert.NoError(t, err, "should succeed")
+			assert.Equal(t, `{"natType":"`+natType.String()+`"}`, string(data), "should match")
+		}
+
+		var res DiscoverResult
+		data := []byte(`{"natType": "endpoint-independent-mapping/address-and-port-dependent-filtering"}`)
+		if assert.NoError(t, json.Unmarshal(data, &res), "should succeed") {
+			assert.Equal(t, NATTypePortRestrictedCone, res.NATType, "should match")
+		}
+	})
+
+	t.Run("Version 1", func(t *testing.T) {
+		data := []byte(`{
+			"isNatted": true,
+			"mappingBehavior": 0,
+			"filteringBehavior": 2,
+			"portPreservation": true,
+			"natType": "Port-restricted cone NAT",
+			"externalIP": "23.3.5.241",
+			"network": "udp4",
+			"translation": 1,
+			"portAllocation": {"pattern": 3},
+			"tcp": {"mappingBehavior": 3}
+		}`)
+
+		var res DiscoverResult
+		if !assert.NoError(t, json.Unmarshal(data, &res), "should succeed") {
+			return
+		}
+		assert.Equal(t, 0, res.SchemaVersion, "should be missing")
+		assert.Equal(t, EndpointIndependent, res.MappingBehavior, "should match")
+		assert.Equal(t, EndpointAddrPortDependent, res.FilteringBehavior, "should match")
+		assert.Equal(t, NATTypePortRestrictedCone, res.NATType, "should match")
+		assert.Equal(t, TranslationNAT, res.Translation, "should match")
+		assert.Equal(t, PortAllocationRandom, res.PortAllocation.Pattern, "should match")
+		assert.Equal(t, EndpointUndefined, res.TCP.MappingBehavior, "should match")
+	})
+
+	t.Run("Invalid values", func(t *testing.T) {
+		var res DiscoverResult
+		assert.Error(t, json.Unmarshal([]byte(`{"natType": "hourglass"}`), &res), "should fail")
+		assert.Error(t, json.Unmarshal([]byte(`{"mappingBehavior": 4}`), &res), "should fail")
+		assert.Error(t, json.Unmarshal([]byte(`{"translation": "nat64"}`), &res), "should fail")
+		assert.Error(t, json.Unmarshal([]byte(`{"portAllocation": {"pattern": -1}}`), &res), "should fail")
+
+		_, err := json.Marshal(&DiscoverResult{NATType: NATType(200)})
+		assert.Error(t, err, "should fail")
+	})
+}
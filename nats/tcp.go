@@ -0,0 +1,204 @@
+package nats
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// Protocols to discover the NAT behavior over
+const (
+	// ProtocolUDP runs the discovery over UDP.
+	ProtocolUDP = "udp"
+	// ProtocolTCP runs the mapping behavior discovery over STUN over TCP
+	// (RFC 5389 Section 7.2.2). The filtering behavior cannot be told as
+	// the server cannot open connections toward the client.
+	ProtocolTCP = "tcp"
+)
+
+// Same as the transaction timeout over TCP of RFC 5389 Section 7.2.2.
+const tcpTransactionTimeout = 39500 * time.Millisecond
+
+// TCPResult contains the results of the discovery over TCP.
+type TCPResult struct {
+	Network          string                 `json:"network"` // "tcp4" or "tcp6"
+	MappingBehavior  EndpointDependencyType `json:"mappingBehavior"`
+	PortPreservation bool                   `json:"portPreservation"`
+	ExternalIP       string                 `json:"externalIP"`
+	LocalPort        int                    `json:"localPort"`
+}
+
+// Discovers the mapping behavior over TCP. Connections are made from the same
+// local port toward the four addresses of the server, and kept open until
+// the end so that the NAT holds all the mappings meanwhile.
+func (nats *NATS) discoverTCP(ctx context.Context) (*DiscoverResult, error) {
+	network := "tcp4"
+	if nats.network == "udp6" {
+		network = "tcp6"
+	}
+
+	toAddrs := [4]*net.TCPAddr{{IP: nats.serverAddr.IP, Port: nats.serverAddr.Port}, nil, nil, nil}
+	mappedAddrs := [4]*net.TCPAddr{nil, nil, nil, nil}
+
+	// Network is left empty, as it tells what the UDP fields were
+	// discovered over, and none were.
+	res := &DiscoverResult{
+		Algorithm:         AlgorithmRFC5780,
+		MappingBehavior:   EndpointUndefined,
+		FilteringBehavior: EndpointUndefined,
+		TCP:               &TCPResult{Network: network},
+	}
+
+	for i := 0; i < len(toAddrs); i++ {
+		conn, err := dialTCP(ctx, network, res.TCP.LocalPort, toAddrs[i])
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, contextError(ctx, "TCP mapping behavior discovery")
+			}
+			return nil, nats.probeError("TCP mapping behavior discovery", i, toAddrs[i], &kindError{ErrServerUnreachable, err})
+		}
+		defer conn.Close()
+
+		if i == 0 {
+			res.TCP.LocalPort = conn.LocalAddr().(*net.TCPAddr).Port
+			nats.log.Debugf("Local port: %d (TCP)", res.TCP.LocalPort)
+		}
+
+		msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		trRes, err := nats.roundTripTCP(ctx, conn, msg)
+		if err != nil {
+			return nil, nats.probeError("TCP mapping behavior discovery", i, toAddrs[i], err)
+		}
+		resMsg := trRes.msg
+
+		var maddr stun.XORMappedAddress
+		if err = maddr.GetFrom(resMsg); err != nil {
+			return nil, nats.probeError("TCP mapping behavior discovery", i, toAddrs[i], errNoXORMappedAddress)
+		}
+		mappedAddrs[i] = &net.TCPAddr{IP: maddr.IP, Port: maddr.Port}
+
+		nats.log.Debugf("MAPPED-ADDRESS (TCP) [%d]: %s", i, mappedAddrs[i].String())
+
+		if i == 0 {
+			caddr, attrName, err := getOtherAddress(resMsg)
+			if err != nil {
+				return nil, nats.probeError("TCP mapping behavior discovery", i, toAddrs[i], err)
+			}
+			res.AlternateAddressAttr = attrName
+
+			toAddrs[1] = &net.TCPAddr{IP: toAddrs[0].IP, Port: caddr.Port}
+			toAddrs[2] = &net.TCPAddr{IP: caddr.IP, Port: toAddrs[0].Port}
+			toAddrs[3] = &net.TCPAddr{IP: caddr.IP, Port: caddr.Port}
+		}
+	}
+
+	res.IsNatted = !nats.findIsLocalIP(mappedAddrs[0].IP)
+	res.ExternalIP = mappedAddrs[0].IP.String()
+	res.TCP.ExternalIP = res.ExternalIP
+	res.TCP.PortPreservation = (mappedAddrs[0].Port == res.TCP.LocalPort)
+	res.TCP.MappingBehavior = EndpointIndependent
+	if res.IsNatted {
+		res.TCP.MappingBehavior = findMappingBehavior([4]int{
+			mappedAddrs[0].Port,
+			mappedAddrs[1].Port,
+			mappedAddrs[2].Port,
+			mappedAddrs[3].Port,
+		})
+	}
+
+	return res, nil
+}
+
+// Connects to the given address from the local port, which may be in use by
+// other connections. A port is assigned if localPort is 0.
+func dialTCP(ctx context.Context, network string, localPort int, to *net.TCPAddr) (net.Conn, error) {
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{Port: localPort},
+		Control:   reuseAddr,
+	}
+	return dialer.DialContext(ctx, network, to.String())
+}
+
+// roundTripTCP performs a STUN transaction over a TCP connection, where the
+// request is not retransmitted, and messages are framed by the length in
+// their header.
+func (nats *NATS) roundTripTCP(ctx context.Context, conn net.Conn, msg *stun.Message) (*transactionResult, error) {
+	return nats.authenticate(msg, func(msg *stun.Message) (*transactionResult, error) {
+		p := nats.startProbe("TCP mapping behavior discovery", conn.LocalAddr(), conn.RemoteAddr(), msg)
+		var trRes *transactionResult
+		res, err := nats.roundTripTCPOnce(ctx, conn, msg)
+		if err == nil {
+			trRes = &transactionResult{msg: res, from: conn.RemoteAddr()}
+		}
+		nats.endProbe(ctx, p, trRes, err)
+		return trRes, err
+	})
+}
+
+// Performs a transaction as roundTripTCP does, without authentication.
+func (nats *NATS) roundTripTCPOnce(ctx context.Context, conn net.Conn, msg *stun.Message) (*stun.Message, error) {
+	timeout := nats.transactionTimeout
+	if timeout == 0 {
+		timeout = tcpTransactionTimeout
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	defer interruptOnDone(ctx, conn.SetDeadline).stop()
+
+	if _, err := conn.Write(msg.Raw); err != nil {
+		if ctx.Err() != nil {
+			return nil, transactionError(parent, ctx, "TCP mapping behavior discovery")
+		}
+		return nil, err
+	}
+
+	for {
+		res, err := readTCPMessage(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, transactionError(parent, ctx, "TCP mapping behavior discovery")
+			}
+			return nil, err
+		}
+		if res.TransactionID != msg.TransactionID {
+			continue // stray response
+		}
+		return res, nil
+	}
+}
+
+// Reads a STUN message from a stream.
+func readTCPMessage(r io.Reader) (*stun.Message, error) {
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[2:4]))
+	if 20+length > maxMessageSize {
+		return nil, &kindError{ErrMalformedResponse, fmt.Errorf("message too large: %d bytes", 20+length)}
+	}
+
+	raw := make([]byte, 20+length)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[20:]); err != nil {
+		return nil, err
+	}
+
+	m := &stun.Message{Raw: raw}
+	if err := m.Decode(); err != nil {
+		return nil, &kindError{ErrMalformedResponse, err}
+	}
+	return m, nil
+}
@@ -0,0 +1,91 @@
+package nats
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/enobufs/go-nats/server"
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverTCP(t *testing.T) {
+	// Needs two loopback addresses, which are not available everywhere.
+	conn, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("127.0.0.2 is not available")
+	}
+	conn.Close() // nolint:errcheck,gosec
+
+	s, err := server.NewServer(&server.Config{
+		PrimaryAddress:   "127.0.0.1:34880",
+		SecondaryAddress: "127.0.0.2:34881",
+		TCP:              true,
+		LoggerFactory:    logging.NewDefaultLoggerFactory(),
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, s.Start(), "should succeed") {
+		return
+	}
+	defer s.Close() // nolint:errcheck,gosec
+
+	nats, err := NewNATS(&Config{
+		Server:   "127.0.0.1:34880",
+		Protocol: ProtocolTCP,
+		Verbose:  true,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	res, err := nats.DiscoverContext(context.Background())
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	assert.Empty(t, res.Network, "should be left to the TCP section")
+	assert.False(t, res.IsNatted, "should not be natted")
+	assert.Equal(t, "127.0.0.1", res.ExternalIP, "should match")
+	assert.Equal(t, "OTHER-ADDRESS", res.AlternateAddressAttr, "should match")
+	assert.Equal(t, EndpointUndefined, res.MappingBehavior, "should be left to the TCP section")
+	assert.Equal(t, EndpointUndefined, res.FilteringBehavior, "should be undefined")
+
+	if !assert.NotNil(t, res.TCP, "should have the TCP section") {
+		return
+	}
+	assert.Equal(t, "tcp4", res.TCP.Network, "should match")
+	assert.Equal(t, EndpointIndependent, res.TCP.MappingBehavior, "should match")
+	assert.True(t, res.TCP.PortPreservation, "should be preserved")
+	assert.Equal(t, "127.0.0.1", res.TCP.ExternalIP, "should match")
+	assert.NotZero(t, res.TCP.LocalPort, "should be set")
+}
+
+func TestTCPConfig(t *testing.T) {
+	t.Run("Virtual network", func(t *testing.T) {
+		_, err := NewNATS(&Config{
+			Server:   "1.2.3.4:3478",
+			Protocol: ProtocolTCP,
+			Net:      vnet.NewNet(&vnet.NetConfig{}),
+		})
+		assert.Error(t, err, "should fail")
+	})
+
+	t.Run("Unsupported protocol", func(t *testing.T) {
+		_, err := NewNATS(&Config{
+			Server:   "1.2.3.4:3478",
+			Protocol: "sctp",
+		})
+		assert.Error(t, err, "should fail")
+	})
+}
+
+func TestFindMappingBehavior(t *testing.T) {
+	assert.Equal(t, EndpointIndependent, findMappingBehavior([4]int{1000, 1000, 1000, 1000}), "should match")
+	assert.Equal(t, EndpointAddrDependent, findMappingBehavior([4]int{1000, 1000, 1001, 1001}), "should match")
+	assert.Equal(t, EndpointAddrPortDependent, findMappingBehavior([4]int{1000, 1001, 1002, 1003}), "should match")
+}
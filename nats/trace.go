@@ -0,0 +1,130 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/stun"
+)
+
+// ProbeTrace records a request sent during a discovery and what came of it.
+// Requests challenged for credentials appear once per attempt.
+type ProbeTrace struct {
+	Op         string `json:"op"` // e.g. "mapping behavior discovery"
+	LocalAddr  string `json:"localAddr"`
+	To         string `json:"to"`
+	ChangeIP   bool   `json:"changeIP,omitempty"`
+	ChangePort bool   `json:"changePort,omitempty"`
+	// Source address of the response. Empty if none came.
+	From string `json:"from,omitempty"`
+	// XOR-MAPPED-ADDRESS, or MAPPED-ADDRESS of RFC 3489 servers, of the
+	// response.
+	MappedAddress string `json:"mappedAddress,omitempty"`
+	// Time from the first transmission to the response.
+	RTT             time.Duration `json:"rtt,omitempty"`
+	Retransmissions int           `json:"retransmissions"`
+	// "success", "error response (<code>)", "no response", "timeout",
+	// "canceled" or the error that occurred otherwise. A transaction timing
+	// out by Config.TransactionTimeout is "no response".
+	Outcome string `json:"outcome"`
+
+	start time.Time
+}
+
+// tracer collects the probes of a discovery. It is carried by the context,
+// so that concurrent discoveries have their own.
+type tracer struct {
+	mutex  sync.Mutex
+	probes []*ProbeTrace
+}
+
+type tracerKey struct{}
+
+func withTracer(ctx context.Context, t *tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// Starts tracing a request, notifying the observer.
+func (nats *NATS) startProbe(op string, local, to net.Addr, req *stun.Message) *ProbeTrace {
+	p := &ProbeTrace{
+		Op:        op,
+		LocalAddr: local.String(),
+		To:        to.String(),
+		start:     time.Now(),
+	}
+
+	var changeReq attr.ChangeRequest
+	if changeReq.GetFrom(req) == nil {
+		p.ChangeIP = changeReq.ChangeIP
+		p.ChangePort = changeReq.ChangePort
+	}
+
+	if nats.observer != nil {
+		sent := *p // not to share what is filled later
+		nats.observer.OnProbeSent(&sent)
+	}
+	return p
+}
+
+// Completes the trace of a request with its outcome, notifying the observer
+// of the response if any, and records it if ctx carries a tracer.
+func (nats *NATS) endProbe(ctx context.Context, p *ProbeTrace, res *transactionResult, err error) {
+	var te *TimeoutError
+	switch {
+	case err == nil:
+		p.From = res.from.String()
+		p.RTT = time.Since(p.start)
+		p.Retransmissions = res.retries
+		if mappedAddr, err := getMappedAddress(res.msg); err == nil {
+			p.MappedAddress = mappedAddr.String()
+		}
+		p.Outcome = "success"
+		if res.msg.Type.Class == stun.ClassErrorResponse {
+			p.Outcome = "error response"
+			var code stun.ErrorCodeAttribute
+			if code.GetFrom(res.msg) == nil {
+				p.Outcome = fmt.Sprintf("error response (%d)", int(code.Code))
+			}
+		}
+	case errors.Is(err, errNoResponse):
+		p.Outcome = "no response"
+	case errors.Is(err, context.Canceled):
+		p.Outcome = "canceled"
+	case errors.As(err, &te):
+		p.Outcome = "timeout"
+	default:
+		p.Outcome = err.Error()
+	}
+
+	if err == nil && nats.observer != nil {
+		received := *p
+		nats.observer.OnResponseReceived(&received)
+	}
+
+	t, ok := ctx.Value(tracerKey{}).(*tracer)
+	if !ok {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.probes = append(t.probes, p)
+}
+
+// Returns the probes recorded so far in the order they were sent.
+func (t *tracer) trace() []*ProbeTrace {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	probes := append([]*ProbeTrace{}, t.probes...)
+	sort.SliceStable(probes, func(i, j int) bool {
+		return probes[i].start.Before(probes[j].start)
+	})
+	return probes
+}
@@ -0,0 +1,120 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrace(t *testing.T) {
+	v, err := buildVNet(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	nats, err := NewNATS(&Config{
+		Server:             "stun.pion.net:3478",
+		Net:                v.net0,
+		TransactionTimeout: 300 * time.Millisecond,
+		Trace:              true,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer nats.Close() // nolint:errcheck,gosec
+
+	res, err := nats.Discover()
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	assert.Equal(t, NATTypePortRestrictedCone, res.NATType, "should match")
+
+	var mapping, filtering, hairpinning []*ProbeTrace
+	for _, p := range res.Trace {
+		switch p.Op {
+		case "mapping behavior discovery":
+			mapping = append(mapping, p)
+		case "filtering behavior discovery":
+			filtering = append(filtering, p)
+		case "hairpinning discovery":
+			hairpinning = append(hairpinning, p)
+		default:
+			t.Errorf("unexpected op: %s", p.Op)
+		}
+	}
+
+	if assert.Equal(t, 4, len(mapping), "should match") {
+		toAddrs := []string{"1.2.3.4:3478", "1.2.3.4:3479", "1.2.3.5:3478", "1.2.3.5:3479"}
+		for i, p := range mapping {
+			assert.Equal(t, toAddrs[i], p.To, "should match")
+			assert.Equal(t, toAddrs[i], p.From, "should match")
+			assert.Equal(t, mapping[0].MappedAddress, p.MappedAddress, "should be endpoint independent")
+			assert.Equal(t, mapping[0].LocalAddr, p.LocalAddr, "should share the socket")
+			assert.True(t, p.RTT > 0, "should have RTT")
+			assert.Equal(t, "success", p.Outcome, "should match")
+		}
+	}
+
+	if assert.Equal(t, 2, len(filtering), "should match") {
+		for _, p := range filtering {
+			assert.True(t, p.ChangeIP != p.ChangePort, "should change either")
+			assert.Empty(t, p.From, "should be filtered")
+			assert.Equal(t, "no response", p.Outcome, "should match")
+		}
+	}
+
+	assert.Equal(t, 2, len(hairpinning), "should match")
+
+	// Not traced by default
+	nats, err = NewNATS(&Config{
+		Server:             "stun.pion.net:3478",
+		Net:                v.net0,
+		TransactionTimeout: 300 * time.Millisecond,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer nats.Close() // nolint:errcheck,gosec
+
+	res, err = nats.Discover()
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	assert.Nil(t, res.Trace, "should not be traced")
+}
+
+func TestProbeOutcome(t *testing.T) {
+	nats := &NATS{}
+	local := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	to := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 3478}
+
+	testCases := []struct {
+		err     error
+		outcome string
+	}{
+		{errNoResponse, "no response"},
+		{&kindError{errNoResponse, &TimeoutError{Op: "test"}}, "no response"},
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("read: %w", context.Canceled), "canceled"},
+		{&TimeoutError{Op: "test"}, "timeout"},
+		{fmt.Errorf("read: %w", &TimeoutError{Op: "test"}), "timeout"},
+		{errors.New("connection refused"), "connection refused"},
+	}
+
+	for _, tc := range testCases {
+		p := nats.startProbe("test", local, to, stun.MustBuild(stun.TransactionID, stun.BindingRequest))
+		nats.endProbe(context.Background(), p, nil, tc.err)
+		assert.Equal(t, tc.outcome, p.Outcome, "should match: %v", tc.err)
+	}
+}
@@ -0,0 +1,200 @@
+package nats
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	defaultRTO     = 200 * time.Millisecond  // same as turn.Client
+	maxRTO         = 1600 * time.Millisecond // same as turn.Client
+	maxRtxCount    = 7                       // same as turn.Client
+	maxMessageSize = 1500
+)
+
+// roundTrip performs a STUN transaction directly over conn, without
+// turn.Client. It is used where turn.Client does not fit: when the socket has
+// to be read by other means as well, or when the response is expected on
+// another socket.
+func (nats *NATS) roundTrip(ctx context.Context, conn net.PacketConn, msg *stun.Message, to net.Addr, op string) (*transactionResult, error) {
+	return nats.roundTripVia(ctx, conn, conn, msg, to, op)
+}
+
+// roundTripVia sends the request from sendConn, retransmitting it as
+// turn.Client does, and waits for the response to arrive on recvConn.
+// recvConn must not be read by anyone else in the meantime.
+func (nats *NATS) roundTripVia(ctx context.Context, sendConn, recvConn net.PacketConn, msg *stun.Message, to net.Addr, op string) (*transactionResult, error) {
+	return nats.roundTripWithin(ctx, sendConn, recvConn, msg, to, nats.transactionTimeout, op)
+}
+
+// roundTripWithin performs a transaction as roundTripVia does, waiting for
+// the response no longer than timeout instead of Config.TransactionTimeout.
+// Zero means no limit other than the retransmission schedule.
+func (nats *NATS) roundTripWithin(ctx context.Context, sendConn, recvConn net.PacketConn, msg *stun.Message, to net.Addr, timeout time.Duration, op string) (*transactionResult, error) {
+	return nats.authenticate(msg, func(msg *stun.Message) (*transactionResult, error) {
+		p := nats.startProbe(op, sendConn.LocalAddr(), to, msg)
+		res, err := nats.roundTripOnce(ctx, sendConn, recvConn, msg, to, timeout, op)
+		nats.endProbe(ctx, p, res, err)
+		return res, err
+	})
+}
+
+// authenticate performs a transaction with do, after adding the credentials
+// to the request if any. A challenge by the server is answered once, and
+// the integrity of the success response is verified.
+func (nats *NATS) authenticate(msg *stun.Message, do func(msg *stun.Message) (*transactionResult, error)) (*transactionResult, error) {
+	for retry := false; ; retry = true {
+		signed := msg
+		if nats.auth != nil {
+			var err error
+			if signed, err = nats.auth.sign(msg, retry); err != nil {
+				return nil, err
+			}
+		}
+
+		res, err := do(signed)
+		if err != nil {
+			return nil, err
+		}
+
+		switch res.msg.Type.Class {
+		case stun.ClassErrorResponse:
+			if nats.auth != nil && !retry && nats.auth.challenged(res.msg) {
+				continue
+			}
+			var code stun.ErrorCodeAttribute
+			if code.GetFrom(res.msg) == nil && code.Code == stun.CodeUnauthorized {
+				return nil, ErrUnauthorized
+			}
+		case stun.ClassSuccessResponse:
+			if nats.auth != nil {
+				if err = nats.auth.check(res.msg); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		return res, nil
+	}
+}
+
+// Performs a transaction as roundTripWithin does, without authentication.
+func (nats *NATS) roundTripOnce(ctx context.Context, sendConn, recvConn net.PacketConn, msg *stun.Message, to net.Addr, timeout time.Duration, op string) (*transactionResult, error) {
+	parent := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	intr := interruptOnDone(ctx, recvConn.SetReadDeadline)
+	defer intr.stop()
+
+	rto := defaultRTO
+	nRtx := 0
+	nextRtx := time.Now().Add(rto)
+
+	if _, err := sendConn.WriteTo(msg.Raw, to); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		if ctx.Err() != nil {
+			return nil, transactionError(parent, ctx, op)
+		}
+
+		if !time.Now().Before(nextRtx) {
+			if nRtx == maxRtxCount-1 {
+				return nil, errNoResponse
+			}
+			if _, err := sendConn.WriteTo(msg.Raw, to); err != nil {
+				return nil, err
+			}
+			nRtx++
+			rto *= 2
+			if rto > maxRTO {
+				rto = maxRTO
+			}
+			nextRtx = time.Now().Add(rto)
+		}
+
+		if err := intr.setDeadline(nextRtx); err != nil {
+			return nil, err
+		}
+
+		n, from, err := recvConn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+
+		res := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if err = res.Decode(); err != nil {
+			continue // not a STUN message
+		}
+		if res.TransactionID != msg.TransactionID {
+			continue // stray response
+		}
+
+		return &transactionResult{
+			msg:     res,
+			from:    from,
+			retries: nRtx,
+		}, nil
+	}
+}
+
+// interrupter unblocks the I/O in progress on a connection as soon as ctx is
+// done, by moving its deadline to the current time. The deadline is set
+// through it meanwhile, not to be moved back past the interruption.
+type interrupter struct {
+	ctx     context.Context
+	set     func(time.Time) error
+	mutex   sync.Mutex
+	stopped bool
+	stopCh  chan struct{}
+}
+
+// Starts interrupting the I/O with set, which sets the deadline, until stop
+// is called.
+func interruptOnDone(ctx context.Context, set func(time.Time) error) *interrupter {
+	i := &interrupter{ctx: ctx, set: set, stopCh: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			i.mutex.Lock()
+			if !i.stopped {
+				i.set(time.Now())
+			}
+			i.mutex.Unlock()
+		case <-i.stopCh:
+		}
+	}()
+	return i
+}
+
+// Sets the deadline to t, or to the current time if ctx is done already.
+func (i *interrupter) setDeadline(t time.Time) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.ctx.Err() != nil {
+		t = time.Now()
+	}
+	return i.set(t)
+}
+
+// Stops interrupting, and clears the deadline.
+func (i *interrupter) stop() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.stopped = true
+	close(i.stopCh)
+	i.set(time.Time{})
+}
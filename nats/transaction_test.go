@@ -0,0 +1,82 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// cancelingConn cancels the transaction right before the deadline of a late
+// retransmission is set, as if it happened between the two.
+type cancelingConn struct {
+	net.PacketConn
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
+	canceled time.Time
+}
+
+func (c *cancelingConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	if c.canceled.IsZero() && time.Until(t) > 700*time.Millisecond {
+		c.canceled = time.Now()
+		c.mutex.Unlock()
+		c.cancel()
+		time.Sleep(50 * time.Millisecond) // for the interruption to happen
+		return c.PacketConn.SetReadDeadline(t)
+	}
+	c.mutex.Unlock()
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+func TestRoundTrip(t *testing.T) {
+	t.Run("Canceled between retransmissions", func(t *testing.T) {
+		v, err := buildVNet(&vnet.NATType{
+			MappingBehavior:   vnet.EndpointIndependent,
+			FilteringBehavior: vnet.EndpointIndependent,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+			return false
+		})
+
+		nats, err := NewNATS(&Config{
+			Server: "stun.pion.net:3478",
+			Net:    v.net0,
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer conn.Close() // nolint:errcheck,gosec
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cc := &cancelingConn{PacketConn: conn, cancel: cancel}
+
+		msg := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		_, err = nats.roundTrip(ctx, cc, msg, nats.serverAddr, "test")
+		assert.True(t, errors.Is(err, context.Canceled), "should be canceled: %v", err)
+
+		cc.mutex.Lock()
+		defer cc.mutex.Unlock()
+		if assert.False(t, cc.canceled.IsZero(), "should have been canceled") {
+			elapsed := time.Since(cc.canceled)
+			assert.True(t, elapsed < 300*time.Millisecond, "should return promptly: %v", elapsed)
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/stun"
+)
+
+const (
+	defaultNonceLifetime = 10 * time.Minute
+	nonceTimestampSize   = 8
+	nonceMACSize         = 8
+)
+
+// AuthConfig has config parameters for authenticating Binding requests with
+// MESSAGE-INTEGRITY or MESSAGE-INTEGRITY-SHA256. (RFC 8489 Section 9)
+type AuthConfig struct {
+	// Users maps the usernames to their passwords. It must not be empty.
+	Users map[string]string
+	// Realm selects the long-term credential mechanism if not empty, where
+	// requests without credentials are challenged with 401, REALM and
+	// NONCE. Otherwise the short-term mechanism is used, and requests
+	// without credentials are rejected with 400.
+	Realm string
+	// NonceLifetime is how long a nonce is accepted before 438 (Stale
+	// Nonce) is returned. Defaults to 10 minutes.
+	NonceLifetime time.Duration
+}
+
+// authenticator verifies the credentials in requests. Nonces are stateless:
+// a timestamp and its HMAC, so that the peer in the distributed mode,
+// sharing the key, accepts them as well.
+type authenticator struct {
+	users    map[string]string
+	realm    string
+	lifetime time.Duration
+	nonceKey []byte
+	now      func() time.Time
+}
+
+// credential is what a request was authenticated with, to sign the response
+// with the same.
+type credential struct {
+	key    []byte
+	sha1   bool // MESSAGE-INTEGRITY
+	sha256 bool // MESSAGE-INTEGRITY-SHA256
+}
+
+// Returns the attributes to sign a response with, which must be added after
+// all others but FINGERPRINT.
+func (c *credential) setters() []stun.Setter {
+	var setters []stun.Setter
+	if c.sha1 {
+		setters = append(setters, stun.MessageIntegrity(c.key))
+	}
+	if c.sha256 {
+		setters = append(setters, attr.MessageIntegritySHA256(c.key))
+	}
+	return setters
+}
+
+func newAuthenticator(config *AuthConfig, peerSecret []byte) (*authenticator, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if len(config.Users) == 0 {
+		return nil, fmt.Errorf("no users to authenticate")
+	}
+
+	lifetime := config.NonceLifetime
+	if lifetime == 0 {
+		lifetime = defaultNonceLifetime
+	}
+
+	// In the distributed mode, the key is derived from the peer secret so
+	// that the nonces are accepted by both servers. The secret itself is
+	// only used for the control channel.
+	var nonceKey []byte
+	if peerSecret != nil {
+		mac := hmac.New(sha256.New, peerSecret)
+		mac.Write([]byte("stun-nonce")) // nolint:errcheck,gosec
+		nonceKey = mac.Sum(nil)
+	} else {
+		nonceKey = make([]byte, sha256.Size)
+		if _, err := rand.Read(nonceKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return &authenticator{
+		users:    config.Users,
+		realm:    config.Realm,
+		lifetime: lifetime,
+		nonceKey: nonceKey,
+		now:      time.Now,
+	}, nil
+}
+
+func (a *authenticator) isLongTerm() bool {
+	return len(a.realm) > 0
+}
+
+// Verifies the credentials of a request. On failure, returns the error code
+// to respond with along with the attributes to challenge the client with.
+func (a *authenticator) verify(m *stun.Message) (*credential, stun.ErrorCode, []stun.Setter) {
+	cred := &credential{
+		sha1:   m.Contains(stun.AttrMessageIntegrity),
+		sha256: m.Contains(attr.TypeMessageIntegritySHA256),
+	}
+
+	var challenge []stun.Setter
+	if a.isLongTerm() {
+		challenge = []stun.Setter{stun.NewRealm(a.realm), stun.NewNonce(a.newNonce())}
+	}
+
+	if !cred.sha1 && !cred.sha256 {
+		if a.isLongTerm() {
+			return nil, stun.CodeUnauthorized, challenge
+		}
+		return nil, stun.CodeBadRequest, nil
+	}
+
+	var username stun.Username
+	if err := username.GetFrom(m); err != nil {
+		return nil, stun.CodeBadRequest, nil
+	}
+
+	if a.isLongTerm() {
+		var realm stun.Realm
+		var nonce stun.Nonce
+		if realm.GetFrom(m) != nil || nonce.GetFrom(m) != nil {
+			return nil, stun.CodeBadRequest, nil
+		}
+		if !a.isValidNonce(nonce.String()) {
+			return nil, stun.CodeStaleNonce, challenge
+		}
+	}
+
+	password, ok := a.users[username.String()]
+	if !ok {
+		return nil, stun.CodeUnauthorized, challenge
+	}
+
+	if a.isLongTerm() {
+		cred.key = stun.NewLongTermIntegrity(username.String(), a.realm, password)
+	} else {
+		cred.key = stun.NewShortTermIntegrity(password)
+	}
+
+	// MESSAGE-INTEGRITY-SHA256 is verified in preference to
+	// MESSAGE-INTEGRITY. (RFC 8489 Section 9.2.4)
+	var err error
+	if cred.sha256 {
+		err = attr.MessageIntegritySHA256(cred.key).Check(m)
+	} else {
+		err = stun.MessageIntegrity(cred.key).Check(m)
+	}
+	if err != nil {
+		return nil, stun.CodeUnauthorized, challenge
+	}
+
+	return cred, 0, nil
+}
+
+// Makes a nonce: hex of the timestamp in ns, and its truncated HMAC.
+func (a *authenticator) newNonce() string {
+	b := make([]byte, nonceTimestampSize, nonceTimestampSize+nonceMACSize)
+	binary.BigEndian.PutUint64(b, uint64(a.now().UnixNano()))
+	return hex.EncodeToString(append(b, a.nonceMAC(b)...))
+}
+
+func (a *authenticator) isValidNonce(nonce string) bool {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != nonceTimestampSize+nonceMACSize {
+		return false
+	}
+
+	ts := b[:nonceTimestampSize]
+	if !hmac.Equal(b[nonceTimestampSize:], a.nonceMAC(ts)) {
+		return false
+	}
+
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(ts)))
+	return a.now().Sub(issued) < a.lifetime
+}
+
+func (a *authenticator) nonceMAC(ts []byte) []byte {
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(ts) // nolint:errcheck,gosec
+	return mac.Sum(nil)[:nonceMACSize]
+}
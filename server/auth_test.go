@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerAuth(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+
+	t.Run("Short-term", func(t *testing.T) {
+		env, server, err := buildEnv(func(config *Config) {
+			config.Auth = &AuthConfig{Users: users}
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer env.close()
+
+		if !assert.NoError(t, server.Start(), "should succeed") {
+			return
+		}
+		defer server.Close() // nolint:errcheck,gosec
+
+		key := stun.NewShortTermIntegrity("secret")
+
+		// Without credentials
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		res, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+		if assert.NoError(t, err, "should succeed") {
+			assertErrorCode(t, res, stun.CodeBadRequest)
+		}
+
+		// Wrong password
+		req = stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+			stun.NewUsername("alice"), stun.NewShortTermIntegrity("wrong"))
+		res, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+		if assert.NoError(t, err, "should succeed") {
+			assertErrorCode(t, res, stun.CodeUnauthorized)
+		}
+
+		// MESSAGE-INTEGRITY
+		req = stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+			stun.NewUsername("alice"), key, stun.Fingerprint)
+		res, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+		if assert.NoError(t, err, "should succeed") {
+			assert.Equal(t, stun.BindingSuccess, res.Type, "should match")
+			assert.NoError(t, key.Check(res), "should be signed")
+			assert.False(t, res.Contains(attr.TypeMessageIntegritySHA256), "should not be signed with SHA-256")
+		}
+
+		// MESSAGE-INTEGRITY-SHA256 only
+		req = stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+			stun.NewUsername("alice"), attr.MessageIntegritySHA256(key))
+		res, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+		if assert.NoError(t, err, "should succeed") {
+			assert.Equal(t, stun.BindingSuccess, res.Type, "should match")
+			assert.NoError(t, attr.MessageIntegritySHA256(key).Check(res), "should be signed")
+			assert.False(t, res.Contains(stun.AttrMessageIntegrity), "should not be signed with SHA-1")
+		}
+
+		assert.Equal(t, uint64(2), atomic.LoadUint64(&server.metrics.authFailures), "should match")
+	})
+
+	t.Run("Long-term", func(t *testing.T) {
+		env, server, err := buildEnv(func(config *Config) {
+			config.Auth = &AuthConfig{Users: users, Realm: "example.org"}
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer env.close()
+
+		if !assert.NoError(t, server.Start(), "should succeed") {
+			return
+		}
+		defer server.Close() // nolint:errcheck,gosec
+
+		// Challenged
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		res, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assertErrorCode(t, res, stun.CodeUnauthorized)
+
+		var realm stun.Realm
+		var nonce stun.Nonce
+		assert.NoError(t, realm.GetFrom(res), "should succeed")
+		assert.NoError(t, nonce.GetFrom(res), "should succeed")
+		assert.Equal(t, "example.org", realm.String(), "should match")
+
+		key := stun.NewLongTermIntegrity("alice", "example.org", "secret")
+
+		// Answered
+		req = stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+			stun.NewUsername("alice"), realm, nonce, key, attr.MessageIntegritySHA256(key))
+		res, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+		if assert.NoError(t, err, "should succeed") {
+			assert.Equal(t, stun.BindingSuccess, res.Type, "should match")
+			assert.NoError(t, key.Check(res), "should be signed")
+			assert.NoError(t, attr.MessageIntegritySHA256(key).Check(res), "should be signed")
+		}
+
+		// Missing NONCE
+		req = stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+			stun.NewUsername("alice"), realm, key)
+		res, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+		if assert.NoError(t, err, "should succeed") {
+			assertErrorCode(t, res, stun.CodeBadRequest)
+		}
+
+		// Stale nonce
+		server.auth.now = func() time.Time {
+			return time.Now().Add(defaultNonceLifetime)
+		}
+		req = stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+			stun.NewUsername("alice"), realm, nonce, key)
+		res, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+		if assert.NoError(t, err, "should succeed") {
+			assertErrorCode(t, res, stun.CodeStaleNonce)
+			var newNonce stun.Nonce
+			assert.NoError(t, newNonce.GetFrom(res), "should succeed")
+			assert.NotEqual(t, nonce.String(), newNonce.String(), "should be renewed")
+		}
+	})
+
+	t.Run("Self-check", func(t *testing.T) {
+		env, server, err := buildEnv(func(config *Config) {
+			config.Auth = &AuthConfig{Users: users, Realm: "example.org"}
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer env.close()
+
+		if !assert.NoError(t, server.Start(), "should succeed") {
+			return
+		}
+		defer server.Close() // nolint:errcheck,gosec
+
+		assert.NoError(t, server.SelfCheck(context.Background()), "should succeed")
+
+		// Only the requests SelfCheck sent skip authentication, not all from
+		// the server's IP address
+		conn, err := env.serverNet.ListenPacket("udp4", "1.2.3.5:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		own := &testEnv{client: conn}
+		defer conn.Close() // nolint:errcheck,gosec
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		res, _, err := own.exchange(req.Raw, "1.2.3.4:3478")
+		if assert.NoError(t, err, "should succeed") {
+			assertErrorCode(t, res, stun.CodeUnauthorized)
+		}
+	})
+
+	t.Run("Nonce key in the distributed mode", func(t *testing.T) {
+		config := &AuthConfig{Users: users, Realm: "example.org"}
+		a1, err := newAuthenticator(config, testSecret)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		a2, err := newAuthenticator(config, testSecret)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		// Shared by the peers, but not the secret of the control channel
+		assert.Equal(t, a1.nonceKey, a2.nonceKey, "should match")
+		assert.NotEqual(t, testSecret, a1.nonceKey, "should be derived")
+	})
+
+	t.Run("No users", func(t *testing.T) {
+		_, err := NewServer(&Config{
+			PrimaryAddress:   "1.2.3.4",
+			SecondaryAddress: "1.2.3.5",
+			Auth:             &AuthConfig{},
+		})
+		assert.Error(t, err, "should fail")
+	})
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of sources tracked before idle ones are swept
+	sourceSweepThreshold = 1024
+	// Sweeps are done at most once per interval, as each is O(n).
+	sourceSweepInterval = time.Second
+	// Hard cap on the sources tracked. New sources beyond it are dropped as
+	// if the global limit was hit, so that a flood from spoofed sources
+	// cannot grow the map without limit.
+	maxSources = 65536
+)
+
+// dropReason tells why a request was dropped by requestFilter.
+type dropReason int
+
+const (
+	dropNone dropReason = iota
+	dropDenied
+	dropSourceRate
+	dropGlobalRate
+)
+
+func (r dropReason) String() string {
+	switch r {
+	case dropNone:
+		return "none"
+	case dropDenied:
+		return "denied"
+	case dropSourceRate:
+		return "source rate"
+	case dropGlobalRate:
+		return "global rate"
+	default:
+		return "unknown"
+	}
+}
+
+// tokenBucket allows rate events per second on average, and up to burst at
+// once.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Tells whether the bucket would be full at now, that is, whether it can be
+// forgotten.
+func (b *tokenBucket) isIdle(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// requestFilter decides whether to handle a request by its source, so that
+// the server cannot be abused as a reflector.
+type requestFilter struct {
+	allow       []*net.IPNet
+	deny        []*net.IPNet
+	sourceRate  float64
+	sourceBurst int
+	sources     map[string]*tokenBucket
+	lastSweep   time.Time
+	global      *tokenBucket
+	now         func() time.Time
+	mutex       sync.Mutex
+}
+
+func newRequestFilter(config *Config) (*requestFilter, error) {
+	allow, err := parseCIDRs(config.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(config.DenyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.PerSourceRate < 0 || config.GlobalRate < 0 {
+		return nil, fmt.Errorf("rate must not be negative")
+	}
+
+	f := &requestFilter{
+		allow:       allow,
+		deny:        deny,
+		sourceRate:  config.PerSourceRate,
+		sourceBurst: defaultBurst(config.PerSourceRate, config.PerSourceBurst),
+		sources:     map[string]*tokenBucket{},
+		now:         time.Now,
+	}
+
+	if config.GlobalRate > 0 {
+		f.global = newTokenBucket(config.GlobalRate,
+			defaultBurst(config.GlobalRate, config.GlobalBurst), f.now())
+	}
+
+	return f, nil
+}
+
+// Burst defaults to one second worth of the rate.
+func defaultBurst(rate float64, burst int) int {
+	if burst > 0 {
+		return burst
+	}
+	return int(math.Max(1, math.Ceil(rate)))
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+func containsIP(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check tells why the request from ip is to be dropped, or dropNone.
+func (f *requestFilter) check(ip net.IP) dropReason {
+	// Deny takes precedence over allow.
+	if containsIP(f.deny, ip) {
+		return dropDenied
+	}
+	if len(f.allow) > 0 && !containsIP(f.allow, ip) {
+		return dropDenied
+	}
+
+	if f.sourceRate == 0 && f.global == nil {
+		return dropNone
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := f.now()
+
+	if f.sourceRate == 0 {
+		if !f.global.allow(now) {
+			return dropGlobalRate
+		}
+		return dropNone
+	}
+
+	key := ip.String()
+	b, ok := f.sources[key]
+	if ok {
+		// Checked before the global limit so that a flooding source does not
+		// use up the tokens of others.
+		if !b.allow(now) {
+			return dropSourceRate
+		}
+		if f.global != nil && !f.global.allow(now) {
+			return dropGlobalRate
+		}
+		return dropNone
+	}
+
+	// A new source is tracked only if the global limit lets it in.
+	if f.global != nil && !f.global.allow(now) {
+		return dropGlobalRate
+	}
+	if len(f.sources) >= sourceSweepThreshold && now.Sub(f.lastSweep) >= sourceSweepInterval {
+		f.sweep(now)
+	}
+	if len(f.sources) >= maxSources {
+		return dropGlobalRate
+	}
+
+	b = newTokenBucket(f.sourceRate, f.sourceBurst, now)
+	b.allow(now) // never fails with a full bucket
+	f.sources[key] = b
+	return dropNone
+}
+
+// Forgets the sources whose buckets are full again.
+func (f *requestFilter) sweep(now time.Time) {
+	f.lastSweep = now
+	for key, b := range f.sources {
+		if b.isIdle(now) {
+			delete(f.sources, key)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestFilter(t *testing.T) {
+	now := time.Unix(1568358000, 0)
+	newFilter := func(config *Config) *requestFilter {
+		f, err := newRequestFilter(config)
+		if !assert.NoError(t, err, "should succeed") {
+			t.FailNow()
+		}
+		f.now = func() time.Time { return now }
+		if f.global != nil {
+			f.global.last = now
+		}
+		return f
+	}
+
+	ipA := net.ParseIP("5.6.7.8")
+	ipB := net.ParseIP("5.6.7.9")
+
+	t.Run("No limit", func(t *testing.T) {
+		f := newFilter(&Config{})
+		for i := 0; i < 100; i++ {
+			assert.Equal(t, dropNone, f.check(ipA), "should pass")
+		}
+	})
+
+	t.Run("CIDR lists", func(t *testing.T) {
+		f := newFilter(&Config{
+			AllowCIDRs: []string{"5.6.7.0/24", "2001:db8::/32"},
+			DenyCIDRs:  []string{"5.6.7.9/32"},
+		})
+		assert.Equal(t, dropNone, f.check(ipA), "should pass")
+		assert.Equal(t, dropDenied, f.check(ipB), "should be denied")
+		assert.Equal(t, dropDenied, f.check(net.ParseIP("1.1.1.1")), "should be denied")
+		assert.Equal(t, dropNone, f.check(net.ParseIP("2001:db8::1")), "should pass")
+	})
+
+	t.Run("Bad CIDR", func(t *testing.T) {
+		_, err := newRequestFilter(&Config{DenyCIDRs: []string{"5.6.7.8"}})
+		assert.Error(t, err, "should fail")
+	})
+
+	t.Run("Per-source rate", func(t *testing.T) {
+		f := newFilter(&Config{PerSourceRate: 2, PerSourceBurst: 3})
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, dropNone, f.check(ipA), "should pass")
+		}
+		assert.Equal(t, dropSourceRate, f.check(ipA), "should be limited")
+
+		// Others are not affected
+		assert.Equal(t, dropNone, f.check(ipB), "should pass")
+
+		// One token per 500ms
+		now = now.Add(500 * time.Millisecond)
+		assert.Equal(t, dropNone, f.check(ipA), "should pass")
+		assert.Equal(t, dropSourceRate, f.check(ipA), "should be limited")
+	})
+
+	t.Run("Global rate", func(t *testing.T) {
+		f := newFilter(&Config{GlobalRate: 2})
+		assert.Equal(t, dropNone, f.check(ipA), "should pass")
+		assert.Equal(t, dropNone, f.check(ipB), "should pass")
+		assert.Equal(t, dropGlobalRate, f.check(ipA), "should be limited")
+		assert.Equal(t, dropGlobalRate, f.check(ipB), "should be limited")
+
+		now = now.Add(time.Second)
+		assert.Equal(t, dropNone, f.check(ipB), "should pass")
+	})
+
+	t.Run("Limited source does not use global tokens", func(t *testing.T) {
+		f := newFilter(&Config{PerSourceRate: 1, GlobalRate: 2})
+		assert.Equal(t, dropNone, f.check(ipA), "should pass")
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, dropSourceRate, f.check(ipA), "should be limited")
+		}
+		assert.Equal(t, dropNone, f.check(ipB), "should pass")
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		f := newFilter(&Config{PerSourceRate: 1})
+		for i := 0; i < sourceSweepThreshold; i++ {
+			f.check(net.IPv4(10, 0, byte(i>>8), byte(i)))
+		}
+		assert.Equal(t, sourceSweepThreshold, len(f.sources), "should match")
+
+		now = now.Add(time.Second)
+		assert.Equal(t, dropNone, f.check(ipA), "should pass")
+		assert.Equal(t, 1, len(f.sources), "idle sources should be swept")
+	})
+	t.Run("Flood from distinct sources", func(t *testing.T) {
+		f := newFilter(&Config{PerSourceRate: 1})
+		for i := 0; i < maxSources+1000; i++ {
+			f.check(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)))
+		}
+		assert.Equal(t, maxSources, len(f.sources), "should be bounded")
+		assert.Equal(t, now, f.lastSweep, "should sweep once per interval")
+		assert.Equal(t, dropGlobalRate, f.check(ipA), "should be dropped when full")
+
+		// Idle sources make room again
+		now = now.Add(time.Second)
+		assert.Equal(t, dropNone, f.check(ipA), "should pass")
+		assert.Equal(t, 1, len(f.sources), "idle sources should be swept")
+	})
+
+	t.Run("New sources beyond global rate are not tracked", func(t *testing.T) {
+		f := newFilter(&Config{PerSourceRate: 1, GlobalRate: 10})
+		for i := 0; i < 1000; i++ {
+			f.check(net.IPv4(10, 0, byte(i>>8), byte(i)))
+		}
+		assert.Equal(t, 10, len(f.sources), "should match")
+	})
+}
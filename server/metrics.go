@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{
+	0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1,
+}
+
+// Reasons of the messages dropped, as labeled in the metrics
+const (
+	dropLabelNotSTUN          = "not_stun"
+	dropLabelBadFingerprint   = "bad_fingerprint"
+	dropLabelNotRequest       = "not_request"
+	dropLabelNotBinding       = "not_binding"
+	dropLabelDenied           = "denied"
+	dropLabelResponseTooLarge = "response_too_large"
+	dropLabelTooManyConns     = "too_many_connections"
+)
+
+var dropLabels = []string{
+	dropLabelNotSTUN,
+	dropLabelBadFingerprint,
+	dropLabelNotRequest,
+	dropLabelNotBinding,
+	dropLabelDenied,
+	dropLabelResponseTooLarge,
+	dropLabelTooManyConns,
+}
+
+// metrics holds the counters of a Server. All counters are updated
+// atomically. The uint64 fields come first to be 64-bit aligned.
+type metrics struct {
+	requests       [numTransports][4]uint64 // Binding requests by transport and index
+	changeRequests [4]uint64                // by changeIP<<1 | changePort
+	decodeFailures uint64
+	authFailures   uint64
+	sourceLimited  uint64
+	globalLimited  uint64
+	latencyCount   uint64
+	latencySumNs   uint64
+	latencyCounts  []uint64           // by latencyBuckets, not cumulative
+	dropped        map[string]*uint64 // by dropLabel*, fixed at creation
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		dropped:       map[string]*uint64{},
+		latencyCounts: make([]uint64, len(latencyBuckets)),
+	}
+	for _, label := range dropLabels {
+		m.dropped[label] = new(uint64)
+	}
+	return m
+}
+
+func (m *metrics) countRequest(t transport, index int) {
+	atomic.AddUint64(&m.requests[t][index], 1)
+}
+
+func (m *metrics) countChangeRequest(changeIP, changePort bool) {
+	i := 0
+	if changeIP {
+		i |= 0x2
+	}
+	if changePort {
+		i |= 0x1
+	}
+	atomic.AddUint64(&m.changeRequests[i], 1)
+}
+
+func (m *metrics) countDecodeFailure() {
+	atomic.AddUint64(&m.decodeFailures, 1)
+}
+
+func (m *metrics) countAuthFailure() {
+	atomic.AddUint64(&m.authFailures, 1)
+}
+
+func (m *metrics) countDropped(label string) {
+	atomic.AddUint64(m.dropped[label], 1)
+}
+
+func (m *metrics) countFiltered(reason dropReason) {
+	switch reason {
+	case dropDenied:
+		m.countDropped(dropLabelDenied)
+	case dropSourceRate:
+		atomic.AddUint64(&m.sourceLimited, 1)
+	case dropGlobalRate:
+		atomic.AddUint64(&m.globalLimited, 1)
+	}
+}
+
+func (m *metrics) observeLatency(d time.Duration) {
+	for i, le := range latencyBuckets {
+		if d.Seconds() <= le {
+			atomic.AddUint64(&m.latencyCounts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&m.latencyCount, 1)
+	atomic.AddUint64(&m.latencySumNs, uint64(d.Nanoseconds()))
+}
+
+// WriteMetrics writes the metrics of the server in the Prometheus text
+// exposition format.
+func (s *Server) WriteMetrics(w io.Writer) error {
+	m := s.metrics
+	bw := bufio.NewWriter(w)
+
+	writeHeader(bw, "stun_server_requests_total", "counter",
+		"Binding requests received, by transport and socket.")
+	for t := transportUDP; t < numTransports; t++ {
+		if !s.listensOn(t) {
+			continue
+		}
+		for i, addr := range s.addrsOf(t) {
+			fmt.Fprintf(bw, "stun_server_requests_total{transport=\"%s\",socket=\"%d\",address=\"%s\"} %d\n",
+				t.String(), i, addr.String(), atomic.LoadUint64(&m.requests[t][i]))
+		}
+	}
+
+	writeHeader(bw, "stun_server_change_requests_total", "counter",
+		"Binding requests received with CHANGE-REQUEST, by its flags.")
+	for i := range m.changeRequests {
+		fmt.Fprintf(bw, "stun_server_change_requests_total{change_ip=\"%t\",change_port=\"%t\"} %d\n",
+			i&0x2 != 0, i&0x1 != 0, atomic.LoadUint64(&m.changeRequests[i]))
+	}
+
+	writeHeader(bw, "stun_server_decode_failures_total", "counter",
+		"STUN messages that failed to decode.")
+	fmt.Fprintf(bw, "stun_server_decode_failures_total %d\n",
+		atomic.LoadUint64(&m.decodeFailures))
+
+	writeHeader(bw, "stun_server_auth_failures_total", "counter",
+		"Binding requests rejected for missing or bad credentials.")
+	fmt.Fprintf(bw, "stun_server_auth_failures_total %d\n",
+		atomic.LoadUint64(&m.authFailures))
+
+	writeHeader(bw, "stun_server_dropped_total", "counter",
+		"Messages not handled as Binding requests, by reason.")
+	for _, label := range dropLabels {
+		fmt.Fprintf(bw, "stun_server_dropped_total{reason=\"%s\"} %d\n",
+			label, atomic.LoadUint64(m.dropped[label]))
+	}
+
+	writeHeader(bw, "stun_server_rate_limited_total", "counter",
+		"Messages dropped by the rate limits, by limit.")
+	fmt.Fprintf(bw, "stun_server_rate_limited_total{limit=\"source\"} %d\n",
+		atomic.LoadUint64(&m.sourceLimited))
+	fmt.Fprintf(bw, "stun_server_rate_limited_total{limit=\"global\"} %d\n",
+		atomic.LoadUint64(&m.globalLimited))
+
+	writeHeader(bw, "stun_server_response_latency_seconds", "histogram",
+		"Time from receiving a request to sending the response.")
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += atomic.LoadUint64(&m.latencyCounts[i])
+		fmt.Fprintf(bw, "stun_server_response_latency_seconds_bucket{le=\"%s\"} %d\n",
+			strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	count := atomic.LoadUint64(&m.latencyCount)
+	fmt.Fprintf(bw, "stun_server_response_latency_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(bw, "stun_server_response_latency_seconds_sum %s\n",
+		strconv.FormatFloat(time.Duration(atomic.LoadUint64(&m.latencySumNs)).Seconds(), 'g', -1, 64))
+	fmt.Fprintf(bw, "stun_server_response_latency_seconds_count %d\n", count)
+
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// MetricsHandler returns an http.Handler serving the metrics of the server,
+// to be registered at /metrics.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := s.WriteMetrics(w); err != nil {
+			s.log.Warnf("failed to write metrics: %s", err.Error())
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	env, server, err := buildEnv(func(config *Config) {
+		config.PerSourceRate = 0.01
+		config.PerSourceBurst = 6
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer env.close()
+
+	if !assert.NoError(t, server.Start(), "should succeed") {
+		return
+	}
+	defer server.Close() // nolint:errcheck,gosec
+
+	// Two Binding requests to socket 0, one of them with CHANGE-REQUEST
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	_, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+	assert.NoError(t, err, "should succeed")
+
+	req = stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+		&attr.ChangeRequest{ChangeIP: true, ChangePort: true})
+	_, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+	assert.NoError(t, err, "should succeed")
+
+	// One to socket 3
+	req = stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	_, _, err = env.exchange(req.Raw, "1.2.3.5:3479")
+	assert.NoError(t, err, "should succeed")
+
+	// Not a request
+	res := stun.MustBuild(stun.TransactionID, stun.BindingSuccess)
+	_, _, err = env.exchange(res.Raw, "1.2.3.4:3478")
+	assert.Error(t, err, "should be dropped")
+
+	// Not a Binding request
+	req = stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest))
+	_, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+	assert.NoError(t, err, "should succeed")
+
+	// Malformed
+	req = stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	raw := append(req.Raw, 0x00, 0x03, 0x00, 0x08)
+	raw[3] = 4
+	_, _, err = env.exchange(raw, "1.2.3.4:3478")
+	assert.NoError(t, err, "should succeed")
+
+	// Rate limited
+	req = stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	_, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+	assert.Error(t, err, "should be dropped")
+
+	rec := httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code, "should succeed")
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"), "should be text")
+
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"# TYPE stun_server_requests_total counter",
+		`stun_server_requests_total{transport="udp",socket="0",address="1.2.3.4:3478"} 2`,
+		`stun_server_requests_total{transport="udp",socket="1",address="1.2.3.4:3479"} 0`,
+		`stun_server_requests_total{transport="udp",socket="3",address="1.2.3.5:3479"} 1`,
+		`stun_server_change_requests_total{change_ip="false",change_port="false"} 0`,
+		`stun_server_change_requests_total{change_ip="true",change_port="true"} 1`,
+		`stun_server_decode_failures_total 1`,
+		`stun_server_dropped_total{reason="not_request"} 1`,
+		`stun_server_dropped_total{reason="not_binding"} 1`,
+		`stun_server_rate_limited_total{limit="source"} 1`,
+		`stun_server_rate_limited_total{limit="global"} 0`,
+		"# TYPE stun_server_response_latency_seconds histogram",
+		`stun_server_response_latency_seconds_bucket{le="+Inf"} 5`,
+		`stun_server_response_latency_seconds_count 5`,
+	} {
+		assert.Contains(t, body, line+"\n", "should be exposed")
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+)
+
+const (
+	controlVersion       = 1
+	controlHeaderSize    = 11 // version, port index, timestamp and IP length
+	controlMACSize       = sha256.Size
+	defaultControlWindow = 5 * time.Second
+	minSecretLength      = 16
+)
+
+// PeerConfig has config parameters for the distributed mode, where two
+// servers on two hosts, each holding one of the two IP addresses, run as one.
+//
+// Each server listens on its own IP address with the two ports, and forwards
+// the responses to be sent from the other IP address (CHANGE-REQUEST with
+// change-IP) to the peer over the control channel. The two servers must use
+// the same primary and secondary ports, and have their primary and secondary
+// IP addresses swapped.
+type PeerConfig struct {
+	// ListenAddress is the address ("IP:port") to receive the responses to
+	// send on behalf of the peer.
+	ListenAddress string
+	// Address is the control channel address ("IP:port") of the peer.
+	Address string
+	// Secret is the key shared with the peer to authenticate the control
+	// messages with. It must be at least 16 bytes long.
+	Secret []byte
+	// Window is how old a control message may be. Defaults to 5 seconds.
+	// The clocks of the two hosts must be in sync within this.
+	Window time.Duration
+}
+
+// peerLink is the control channel to the peer.
+//
+// A control message is:
+//
+//	version (1) | port index (1) | timestamp in ns (8) | IP length (1) |
+//	destination IP (4 or 16) | destination port (2) | STUN message |
+//	HMAC-SHA256 over all preceding bytes (32)
+type peerLink struct {
+	listenAddr string
+	conn       net.PacketConn
+	peerAddr   *net.UDPAddr
+	secret     []byte
+	window     time.Duration
+	seen       map[string]time.Time // MACs of messages received within window
+	seenOrder  []seenMAC            // keys of seen in the order received
+	mutex      sync.Mutex
+}
+
+type seenMAC struct {
+	key string
+	at  time.Time
+}
+
+func newPeerLink(config *PeerConfig, n *vnet.Net) (*peerLink, error) {
+	if len(config.Secret) < minSecretLength {
+		return nil, fmt.Errorf("peer secret must be at least %d bytes long", minSecretLength)
+	}
+
+	peerAddr, err := n.ResolveUDPAddr("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	window := config.Window
+	if window == 0 {
+		window = defaultControlWindow
+	}
+
+	return &peerLink{
+		listenAddr: config.ListenAddress,
+		peerAddr:   peerAddr,
+		secret:     append([]byte{}, config.Secret...),
+		window:     window,
+		seen:       map[string]time.Time{},
+	}, nil
+}
+
+func (l *peerLink) listen(n *vnet.Net) error {
+	laddr, err := n.ResolveUDPAddr("udp", l.listenAddr)
+	if err != nil {
+		return err
+	}
+
+	l.conn, err = n.ListenUDP("udp", laddr)
+	return err
+}
+
+// controlMessage tells the peer to send payload to dest from its socket of
+// the primary port (portIndex 0) or the secondary port (portIndex 1).
+type controlMessage struct {
+	portIndex int
+	timestamp time.Time
+	dest      *net.UDPAddr
+	payload   []byte
+}
+
+func (l *peerLink) marshal(cm *controlMessage) []byte {
+	ip := cm.dest.IP.To4()
+	if ip == nil {
+		ip = cm.dest.IP.To16()
+	}
+
+	buf := make([]byte, controlHeaderSize, controlHeaderSize+len(ip)+2+len(cm.payload)+controlMACSize)
+	buf[0] = controlVersion
+	buf[1] = byte(cm.portIndex)
+	binary.BigEndian.PutUint64(buf[2:10], uint64(cm.timestamp.UnixNano()))
+	buf[10] = byte(len(ip))
+	buf = append(buf, ip...)
+	buf = append(buf, byte(cm.dest.Port>>8), byte(cm.dest.Port))
+	buf = append(buf, cm.payload...)
+
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write(buf) // nolint:errcheck,gosec
+	return mac.Sum(buf)
+}
+
+// Authenticates and decodes a control message received at now.
+func (l *peerLink) unmarshal(buf []byte, now time.Time) (*controlMessage, error) {
+	if len(buf) < controlHeaderSize+controlMACSize {
+		return nil, fmt.Errorf("control message too short")
+	}
+
+	body := buf[:len(buf)-controlMACSize]
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write(body) // nolint:errcheck,gosec
+	if !hmac.Equal(mac.Sum(nil), buf[len(body):]) {
+		return nil, fmt.Errorf("control message not authenticated")
+	}
+
+	if body[0] != controlVersion {
+		return nil, fmt.Errorf("unsupported control message version %d", body[0])
+	}
+
+	cm := &controlMessage{
+		portIndex: int(body[1]),
+		timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(body[2:10]))),
+	}
+	if cm.portIndex > 1 {
+		return nil, fmt.Errorf("bad port index %d", cm.portIndex)
+	}
+
+	age := now.Sub(cm.timestamp)
+	if age > l.window || age < -l.window {
+		return nil, fmt.Errorf("control message out of window: %v", age)
+	}
+
+	ipLen := int(body[10])
+	if ipLen != net.IPv4len && ipLen != net.IPv6len {
+		return nil, fmt.Errorf("bad IP length %d", ipLen)
+	}
+	rest := body[controlHeaderSize:]
+	if len(rest) < ipLen+2 {
+		return nil, fmt.Errorf("control message too short")
+	}
+	cm.dest = &net.UDPAddr{
+		IP:   net.IP(append([]byte{}, rest[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(rest[ipLen : ipLen+2])),
+	}
+	cm.payload = rest[ipLen+2:]
+
+	// Only Binding responses may be relayed, so the peer cannot be used to
+	// send anything else even if the secret leaked.
+	m := &stun.Message{Raw: append([]byte{}, cm.payload...)}
+	if err := m.Decode(); err != nil {
+		return nil, fmt.Errorf("payload is not a STUN message: %s", err.Error())
+	}
+	if m.Type.Method != stun.MethodBinding || m.Type.Class == stun.ClassRequest {
+		return nil, fmt.Errorf("payload is not a Binding response")
+	}
+
+	if !l.checkReplay(buf[len(body):], now) {
+		return nil, fmt.Errorf("control message replayed")
+	}
+
+	return cm, nil
+}
+
+// Records the MAC of a message, and tells whether it has not been seen
+// within the window.
+func (l *peerLink) checkReplay(mac []byte, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Expire from the oldest, so that each message costs O(1) amortized.
+	for len(l.seenOrder) > 0 && now.Sub(l.seenOrder[0].at) > 2*l.window {
+		delete(l.seen, l.seenOrder[0].key)
+		l.seenOrder = l.seenOrder[1:]
+	}
+
+	key := string(mac)
+	if _, ok := l.seen[key]; ok {
+		return false
+	}
+	l.seen[key] = now
+	l.seenOrder = append(l.seenOrder, seenMAC{key: key, at: now})
+	return true
+}
+
+// Asks the peer to send raw to the client from its socket of index.
+func (s *Server) forward(index int, raw []byte, to net.Addr) error {
+	cm := &controlMessage{
+		portIndex: index & 0x1,
+		timestamp: time.Now(),
+		dest:      to.(*net.UDPAddr),
+		payload:   raw,
+	}
+
+	s.log.Debugf("forwarding response to %s via peer", to.String())
+	_, err := s.peer.conn.WriteTo(s.peer.marshal(cm), s.peer.peerAddr)
+	return err
+}
+
+func (s *Server) controlLoop() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxMessageSize+controlHeaderSize+net.IPv6len+2+controlMACSize)
+	for {
+		n, from, err := s.peer.conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			s.log.Errorf("controlLoop: %s", err.Error())
+			s.fail(err)
+			return
+		}
+
+		cm, err := s.peer.unmarshal(buf[:n], time.Now())
+		if err != nil {
+			s.log.Warnf("controlLoop: dropped message from %s: %s", from.String(), err.Error())
+			continue
+		}
+
+		s.log.Debugf("sending response to %s on behalf of peer", cm.dest.String())
+		if _, err = s.conns[cm.portIndex].WriteTo(cm.payload, cm.dest); err != nil {
+			s.log.Warnf("controlLoop: failed to send: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSecret = []byte("0123456789abcdef")
+
+// Runs two servers in the distributed mode, A on 1.2.3.4 and B on 1.2.3.5.
+func buildPeerEnv() (*testEnv, *Server, *Server, error) {
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "0.0.0.0/0",
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	netA := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"1.2.3.4"}})
+	netB := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"1.2.3.5"}})
+	clientNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"5.6.7.8"}})
+	for _, n := range []*vnet.Net{netA, netB, clientNet} {
+		if err = wan.AddNet(n); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if err = wan.Start(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	serverA, err := NewServer(&Config{
+		PrimaryAddress:   "1.2.3.4:3478",
+		SecondaryAddress: "1.2.3.5:3479",
+		Peer: &PeerConfig{
+			ListenAddress: "1.2.3.4:3480",
+			Address:       "1.2.3.5:3480",
+			Secret:        testSecret,
+		},
+		Net:           netA,
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	serverB, err := NewServer(&Config{
+		PrimaryAddress:   "1.2.3.5:3478",
+		SecondaryAddress: "1.2.3.4:3479",
+		Peer: &PeerConfig{
+			ListenAddress: "1.2.3.5:3480",
+			Address:       "1.2.3.4:3480",
+			Secret:        testSecret,
+		},
+		Net:           netB,
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	client, err := clientNet.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return &testEnv{wan: wan, serverNet: netA, client: client}, serverA, serverB, nil
+}
+
+func TestDistributedServer(t *testing.T) {
+	env, serverA, serverB, err := buildPeerEnv()
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer env.close()
+
+	for _, s := range []*Server{serverA, serverB} {
+		if !assert.NoError(t, s.Start(), "should succeed") {
+			return
+		}
+		defer s.Close() // nolint:errcheck,gosec
+		assert.NoError(t, s.SelfCheck(context.Background()), "should succeed")
+	}
+
+	testCases := []struct {
+		name       string
+		to         string
+		changeIP   bool
+		changePort bool
+		expected   string
+		other      string
+	}{
+		{"A without change", "1.2.3.4:3478", false, false, "1.2.3.4:3478", "1.2.3.5:3479"},
+		{"A with change-port", "1.2.3.4:3478", false, true, "1.2.3.4:3479", "1.2.3.5:3479"},
+		{"A with change-IP", "1.2.3.4:3478", true, false, "1.2.3.5:3478", "1.2.3.5:3479"},
+		{"A with change-IP and port", "1.2.3.4:3478", true, true, "1.2.3.5:3479", "1.2.3.5:3479"},
+		{"A alternate port with change-IP", "1.2.3.4:3479", true, false, "1.2.3.5:3479", "1.2.3.5:3478"},
+		{"B with change-IP and port", "1.2.3.5:3478", true, true, "1.2.3.4:3479", "1.2.3.4:3479"},
+		{"B alternate port with change-IP", "1.2.3.5:3479", true, false, "1.2.3.4:3479", "1.2.3.4:3478"},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			req := stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+				&attr.ChangeRequest{ChangeIP: tc.changeIP, ChangePort: tc.changePort})
+			res, from, err := env.exchange(req.Raw, tc.to)
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			assert.Equal(t, tc.expected, from.String(), "should match")
+
+			var mapped stun.XORMappedAddress
+			assert.NoError(t, mapped.GetFrom(res), "should succeed")
+			assert.Equal(t, "5.6.7.8", mapped.IP.String(), "should match")
+
+			var origin attr.ResponseOrigin
+			assert.NoError(t, origin.GetFrom(res), "should succeed")
+			assert.Equal(t, tc.expected, origin.String(), "should match")
+
+			var other attr.OtherAddress
+			assert.NoError(t, other.GetFrom(res), "should succeed")
+			assert.Equal(t, tc.other, other.String(), "should match")
+		})
+	}
+}
+
+func TestPeerLink(t *testing.T) {
+	link := &peerLink{
+		secret: testSecret,
+		window: time.Second,
+		seen:   map[string]time.Time{},
+	}
+
+	res := stun.MustBuild(stun.TransactionID, stun.BindingSuccess)
+	now := time.Now()
+	cm := &controlMessage{
+		portIndex: 1,
+		timestamp: now,
+		dest:      &net.UDPAddr{IP: net.ParseIP("5.6.7.8"), Port: 5000},
+		payload:   res.Raw,
+	}
+
+	t.Run("Round trip", func(t *testing.T) {
+		got, err := link.unmarshal(link.marshal(cm), now)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.Equal(t, 1, got.portIndex, "should match")
+		assert.Equal(t, "5.6.7.8:5000", got.dest.String(), "should match")
+		assert.Equal(t, res.Raw, got.payload, "should match")
+	})
+
+	t.Run("Replayed", func(t *testing.T) {
+		buf := link.marshal(&controlMessage{
+			portIndex: 0,
+			timestamp: now,
+			dest:      cm.dest,
+			payload:   res.Raw,
+		})
+		_, err := link.unmarshal(buf, now)
+		assert.NoError(t, err, "should succeed")
+		_, err = link.unmarshal(buf, now)
+		assert.Error(t, err, "should fail")
+	})
+
+	t.Run("Expired MACs", func(t *testing.T) {
+		link := &peerLink{
+			secret: testSecret,
+			window: time.Second,
+			seen:   map[string]time.Time{},
+		}
+		for i := 0; i < 10; i++ {
+			assert.True(t, link.checkReplay([]byte{byte(i)}, now), "should be new")
+		}
+		assert.False(t, link.checkReplay([]byte{0}, now), "should be seen")
+
+		assert.True(t, link.checkReplay([]byte{10}, now.Add(3*time.Second)), "should be new")
+		assert.Equal(t, 1, len(link.seen), "should be forgotten")
+		assert.Equal(t, 1, len(link.seenOrder), "should be forgotten")
+		assert.True(t, link.checkReplay([]byte{0}, now.Add(3*time.Second)), "should be new again")
+	})
+
+	t.Run("Wrong secret", func(t *testing.T) {
+		other := &peerLink{
+			secret: []byte("fedcba9876543210"),
+			window: time.Second,
+			seen:   map[string]time.Time{},
+		}
+		_, err := link.unmarshal(other.marshal(cm), now)
+		assert.Error(t, err, "should fail")
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		buf := link.marshal(cm)
+		buf[12] ^= 0x01 // destination IP
+		_, err := link.unmarshal(buf, now)
+		assert.Error(t, err, "should fail")
+	})
+
+	t.Run("Too old", func(t *testing.T) {
+		_, err := link.unmarshal(link.marshal(cm), now.Add(2*time.Second))
+		assert.Error(t, err, "should fail")
+	})
+
+	t.Run("Not a response", func(t *testing.T) {
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		_, err := link.unmarshal(link.marshal(&controlMessage{
+			timestamp: now,
+			dest:      cm.dest,
+			payload:   req.Raw,
+		}), now)
+		assert.Error(t, err, "should fail")
+	})
+}
+
+func TestPeerConfig(t *testing.T) {
+	_, err := NewServer(&Config{
+		PrimaryAddress:   "1.2.3.4",
+		SecondaryAddress: "1.2.3.5",
+		Peer: &PeerConfig{
+			ListenAddress: "1.2.3.4:3480",
+			Address:       "1.2.3.5:3480",
+			Secret:        []byte("short"),
+		},
+	})
+	assert.Error(t, err, "should fail")
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	selfCheckTimeout  = 500 * time.Millisecond
+	selfCheckAttempts = 3
+)
+
+// SelfCheck verifies that the four sockets are bound to distinct addresses
+// forming two IPs times two ports, and that each of them answers a Binding
+// request. In the distributed mode, only the two sockets on this host are
+// checked. The server must have been started.
+func (s *Server) SelfCheck(ctx context.Context) error {
+	var locals [4]*net.UDPAddr
+	seen := map[string]bool{}
+	for i, conn := range s.conns {
+		if !s.isLocal(i) {
+			continue
+		}
+		if conn == nil {
+			return fmt.Errorf("self-check: socket %d is not bound", i)
+		}
+		locals[i] = conn.LocalAddr().(*net.UDPAddr)
+		if seen[locals[i].String()] {
+			return fmt.Errorf("self-check: %s is bound more than once", locals[i].String())
+		}
+		seen[locals[i].String()] = true
+	}
+
+	// Index 0 and 1 share the primary IP, and index 0 and 2 share the
+	// primary port. (see NewServer)
+	if !locals[0].IP.Equal(locals[1].IP) || locals[0].Port == locals[1].Port {
+		return fmt.Errorf("self-check: sockets of the primary IP address are not bound to two distinct ports")
+	}
+	if s.peer == nil {
+		if !locals[2].IP.Equal(locals[3].IP) || locals[0].IP.Equal(locals[2].IP) {
+			return fmt.Errorf("self-check: sockets are not bound to two distinct IP addresses")
+		}
+		if locals[0].Port != locals[2].Port || locals[1].Port != locals[3].Port {
+			return fmt.Errorf("self-check: sockets are not bound to two distinct ports")
+		}
+	}
+
+	for i, addr := range locals {
+		if addr == nil {
+			continue
+		}
+		if err := s.checkSocket(ctx, addr); err != nil {
+			return fmt.Errorf("self-check: socket %d (%s): %s", i, addr.String(), err.Error())
+		}
+		s.log.Debugf("self-check: %s is ready", addr.String())
+	}
+
+	for t := transportTCP; t < numTransports; t++ {
+		if !s.listensOn(t) {
+			continue
+		}
+		for i, addr := range s.addrsOf(t) {
+			if !s.isLocal(i) {
+				continue
+			}
+			if err := s.checkStream(t, addr); err != nil {
+				return fmt.Errorf("self-check: %s listener %d (%s): %s",
+					t.String(), i, addr.String(), err.Error())
+			}
+			s.log.Debugf("self-check: %s over %s is ready", addr.String(), t.String())
+		}
+	}
+
+	s.log.Info("self-check passed")
+	return nil
+}
+
+// Registers the transaction ID of a request SelfCheck is about to send, so
+// that it is neither filtered nor authenticated. The returned function
+// unregisters it.
+func (s *Server) registerSelfCheck(msg *stun.Message) func() {
+	s.selfCheckMutex.Lock()
+	defer s.selfCheckMutex.Unlock()
+
+	s.selfChecks[msg.TransactionID] = struct{}{}
+	return func() {
+		s.selfCheckMutex.Lock()
+		defer s.selfCheckMutex.Unlock()
+		delete(s.selfChecks, msg.TransactionID)
+	}
+}
+
+// Tells whether the message in raw was sent by SelfCheck. The source address
+// alone could be spoofed, so the transaction ID must be one registered.
+func (s *Server) isSelfCheck(from net.Addr, raw []byte) bool {
+	if !stun.IsMessage(raw) {
+		return false
+	}
+	if ip, _ := ipPort(from); !s.isOwnIP(ip) {
+		return false
+	}
+
+	var transactionID [stun.TransactionIDSize]byte
+	copy(transactionID[:], raw[8:20])
+
+	s.selfCheckMutex.Lock()
+	defer s.selfCheckMutex.Unlock()
+	_, ok := s.selfChecks[transactionID]
+	return ok
+}
+
+// Sends a Binding request to addr from an ephemeral socket, and waits for
+// the response from addr.
+func (s *Server) checkSocket(ctx context.Context, addr *net.UDPAddr) error {
+	laddr := "0.0.0.0:0"
+	if addr.IP.To4() == nil {
+		laddr = "[::]:0"
+	}
+
+	conn, err := s.net.ListenPacket("udp", laddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return err
+	}
+	defer s.registerSelfCheck(msg)()
+
+	buf := make([]byte, maxMessageSize)
+	for i := 0; i < selfCheckAttempts; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if _, err = conn.WriteTo(msg.Raw, addr); err != nil {
+			return err
+		}
+
+		if err = conn.SetReadDeadline(time.Now().Add(selfCheckTimeout)); err != nil {
+			return err
+		}
+
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				break // retransmit
+			}
+
+			res := &stun.Message{Raw: buf[:n]}
+			if res.Decode() != nil || res.TransactionID != msg.TransactionID {
+				continue
+			}
+
+			if from.String() != addr.String() {
+				return fmt.Errorf("response came from %s", from.String())
+			}
+			if res.Type != stun.BindingSuccess {
+				return fmt.Errorf("unexpected response: %s", res.Type.String())
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no response")
+}
+
+// Connects to addr over t, and sends a Binding request.
+func (s *Server) checkStream(t transport, addr *net.UDPAddr) error {
+	hostPort := (&net.TCPAddr{IP: addr.IP, Port: addr.Port}).String()
+	dialer := &net.Dialer{Timeout: selfCheckTimeout}
+
+	var conn net.Conn
+	var err error
+	if t == transportTLS {
+		// Only checking that our own listener works. The certificate may
+		// not be for the IP address.
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostPort, &tls.Config{
+			InsecureSkipVerify: true,
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", hostPort)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return err
+	}
+	defer s.registerSelfCheck(msg)()
+
+	if err = conn.SetDeadline(time.Now().Add(selfCheckTimeout)); err != nil {
+		return err
+	}
+
+	if _, err = conn.Write(msg.Raw); err != nil {
+		return err
+	}
+
+	res, err := readStreamMessage(conn)
+	if err != nil {
+		return err
+	}
+
+	if res.TransactionID != msg.TransactionID {
+		return fmt.Errorf("transaction ID mismatch")
+	}
+	if res.Type != stun.BindingSuccess {
+		return fmt.Errorf("unexpected response: %s", res.Type.String())
+	}
+	return nil
+}
@@ -0,0 +1,702 @@
+// Package server implements a STUN server for NAT behavior discovery as
+// defined in RFC 5780. It listens on two IP addresses and two ports, that is,
+// four sockets, so that it can honor CHANGE-REQUEST.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+)
+
+const (
+	defaultPrimaryPort     = 3478
+	defaultSecondaryPort   = 3479
+	defaultMaxResponseSize = 1400
+	maxMessageSize         = 1500
+)
+
+// Attributes to tell the alternate address with
+const (
+	AttrTypeChangedAddress = attr.TypeChangedAddress // CHANGED-ADDRESS
+	AttrTypeOtherAddress   = attr.TypeOtherAddress   // OTHER-ADDRESS
+)
+
+// Config has config parameters for NewServer.
+type Config struct {
+	// PrimaryAddress is the address ("IP:port") the clients send requests
+	// to. The port defaults to 3478.
+	PrimaryAddress string
+	// SecondaryAddress is the alternate address ("IP:port"), which must
+	// differ from the primary address in both IP and port. The port
+	// defaults to 3479.
+	SecondaryAddress string
+	// Software is sent in SOFTWARE attribute, if not empty.
+	Software string
+	// Attributes to tell the alternate address with. Defaults to
+	// OTHER-ADDRESS only. Add CHANGED-ADDRESS for RFC 3489 clients.
+	// RESPONSE-ORIGIN is sent along with OTHER-ADDRESS.
+	AlternateAddressAttrs []stun.AttrType
+	// Responds from the receiving address regardless of CHANGE-REQUEST,
+	// as some RFC 3489 servers do. Intended for testing clients.
+	IgnoreChangeRequest bool
+	// Sends MAPPED-ADDRESS instead of XOR-MAPPED-ADDRESS, as RFC 3489
+	// servers do.
+	LegacyMappedAddress bool
+	// TCP enables listening on TCP at the four addresses as well. CHANGE-REQUEST
+	// and RESPONSE-PORT are rejected over TCP, as the responses can only be
+	// sent on the connection. Requires the real network.
+	TCP bool
+	// TLSConfig enables listening on TLS at the two IP addresses with
+	// TLSPrimaryPort and TLSSecondaryPort. Requires the real network.
+	TLSConfig *tls.Config
+	// TLSPrimaryPort defaults to 5349. Set 443 to pass through firewalls
+	// only allowing HTTPS.
+	TLSPrimaryPort int
+	// TLSSecondaryPort defaults to 5350.
+	TLSSecondaryPort int
+	// MaxConnections limits the TCP and TLS connections open at once.
+	// Defaults to 1000.
+	MaxConnections int
+	// PerSourceRate limits the requests handled from each source IP address
+	// per second. 0 (default) disables the limit. Up to 65536 sources are
+	// tracked at once, and requests from others are dropped meanwhile.
+	PerSourceRate float64
+	// PerSourceBurst is how many requests from a source IP address may be
+	// handled at once. Defaults to one second worth of PerSourceRate.
+	PerSourceBurst int
+	// GlobalRate limits the requests handled per second in total.
+	// 0 (default) disables the limit.
+	GlobalRate float64
+	// GlobalBurst is how many requests may be handled at once in total.
+	// Defaults to one second worth of GlobalRate.
+	GlobalBurst int
+	// AllowCIDRs lists the source networks to handle requests from. If
+	// empty (default), requests from anywhere not denied are handled.
+	AllowCIDRs []string
+	// DenyCIDRs lists the source networks to drop requests from. It takes
+	// precedence over AllowCIDRs.
+	DenyCIDRs []string
+	// MaxResponseSize is the size in bytes beyond which responses are not
+	// sent, bounding what PADDING can make the server send. Defaults to
+	// 1400. Negative means no limit. Regardless of it, responses redirected
+	// by RESPONSE-PORT are not sent if larger than the request, unless the
+	// request was authenticated.
+	MaxResponseSize int
+	// Peer enables the distributed mode, where this server holds only the
+	// primary IP address, and the peer holds the secondary one. See
+	// PeerConfig.
+	Peer *PeerConfig
+	// Auth, when set, requires Binding requests to be authenticated. See
+	// AuthConfig. Requests sent by SelfCheck are exempt.
+	Auth *AuthConfig
+	// Net is the network to listen on. Defaults to the real network.
+	Net *vnet.Net
+	// LoggerFactory defaults to logging.NewDefaultLoggerFactory().
+	LoggerFactory logging.LoggerFactory
+}
+
+// Server is a STUN server for NAT behavior discovery.
+type Server struct {
+	addrs     [4]*net.UDPAddr
+	conns     [4]net.PacketConn
+	tlsAddrs  [4]*net.UDPAddr
+	tcp       bool
+	tlsConfig *tls.Config
+	listeners []net.Listener
+	streams   map[net.Conn]struct{}
+	maxConns  int
+	software  stun.Software
+	altAttrs  []stun.AttrType
+	ignoreCR  bool
+	legacy    bool
+	filter    *requestFilter
+	metrics   *metrics
+	maxSize   int
+	peer      *peerLink
+	auth      *authenticator
+	net       *vnet.Net
+	log       logging.LeveledLogger
+	wg        sync.WaitGroup
+	mutex     sync.Mutex
+	closed    bool
+	errCh     chan error
+	// Transaction IDs of the requests SelfCheck has in flight
+	selfChecks     map[[stun.TransactionIDSize]byte]struct{}
+	selfCheckMutex sync.Mutex
+}
+
+// NewServer creates a new Server. Call Start or Serve to run it.
+func NewServer(config *Config) (*Server, error) {
+	loggerFactory := config.LoggerFactory
+	if loggerFactory == nil {
+		loggerFactory = logging.NewDefaultLoggerFactory()
+	}
+	log := loggerFactory.NewLogger("stun-serv")
+
+	priHost, priPort, err := splitHostPort(config.PrimaryAddress, defaultPrimaryPort)
+	if err != nil {
+		return nil, err
+	}
+	secHost, secPort, err := splitHostPort(config.SecondaryAddress, defaultSecondaryPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if priPort == secPort {
+		return nil, fmt.Errorf("primary and secondary ports must differ")
+	}
+
+	n := config.Net
+	if n == nil {
+		n = vnet.NewNet(nil)
+	}
+
+	// Index 0 is the primary address. Flipping bit 1 changes the IP, and
+	// flipping bit 0 changes the port.
+	hostPorts := [4]string{
+		net.JoinHostPort(priHost, priPort),
+		net.JoinHostPort(priHost, secPort),
+		net.JoinHostPort(secHost, priPort),
+		net.JoinHostPort(secHost, secPort),
+	}
+
+	addrs := [4]*net.UDPAddr{}
+	for i, hostPort := range hostPorts {
+		addrs[i], err = n.ResolveUDPAddr("udp", hostPort)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if addrs[0].IP.Equal(addrs[2].IP) {
+		return nil, fmt.Errorf("primary and secondary IP addresses must differ")
+	}
+
+	if (config.TCP || config.TLSConfig != nil) && n.IsVirtual() {
+		return nil, fmt.Errorf("TCP and TLS require the real network")
+	}
+
+	tlsPorts := [2]int{config.TLSPrimaryPort, config.TLSSecondaryPort}
+	if tlsPorts[0] == 0 {
+		tlsPorts[0] = defaultTLSPrimaryPort
+	}
+	if tlsPorts[1] == 0 {
+		tlsPorts[1] = defaultTLSSecondaryPort
+	}
+	if config.TLSConfig != nil && tlsPorts[0] == tlsPorts[1] {
+		return nil, fmt.Errorf("TLS primary and secondary ports must differ")
+	}
+
+	tlsAddrs := [4]*net.UDPAddr{}
+	for i, addr := range addrs {
+		tlsAddrs[i] = &net.UDPAddr{IP: addr.IP, Port: tlsPorts[i&0x1]}
+	}
+
+	altAttrs := config.AlternateAddressAttrs
+	if len(altAttrs) == 0 {
+		altAttrs = []stun.AttrType{attr.TypeOtherAddress}
+	}
+	for _, t := range altAttrs {
+		if t != attr.TypeOtherAddress && t != attr.TypeChangedAddress {
+			return nil, fmt.Errorf("unsupported alternate address attribute: %s", t.String())
+		}
+	}
+
+	var software stun.Software
+	if len(config.Software) > 0 {
+		software = stun.NewSoftware(config.Software)
+	}
+
+	maxSize := config.MaxResponseSize
+	if maxSize == 0 {
+		maxSize = defaultMaxResponseSize
+	}
+
+	maxConns := config.MaxConnections
+	if maxConns < 0 {
+		return nil, fmt.Errorf("max connections must not be negative")
+	}
+	if maxConns == 0 {
+		maxConns = defaultMaxConnections
+	}
+
+	filter, err := newRequestFilter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var peer *peerLink
+	var peerSecret []byte
+	if config.Peer != nil {
+		peer, err = newPeerLink(config.Peer, n)
+		if err != nil {
+			return nil, err
+		}
+		peerSecret = config.Peer.Secret
+	}
+
+	auth, err := newAuthenticator(config.Auth, peerSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		addrs:     addrs,
+		tlsAddrs:  tlsAddrs,
+		tcp:       config.TCP,
+		tlsConfig: config.TLSConfig,
+		streams:   map[net.Conn]struct{}{},
+		maxConns:  maxConns,
+		software:  software,
+		altAttrs:  altAttrs,
+		ignoreCR:  config.IgnoreChangeRequest,
+		legacy:    config.LegacyMappedAddress,
+		filter:    filter,
+		metrics:   newMetrics(),
+		maxSize:   maxSize,
+		peer:      peer,
+		auth:      auth,
+		net:       n,
+		log:       log,
+		errCh:     make(chan error, 1),
+
+		selfChecks: map[[stun.TransactionIDSize]byte]struct{}{},
+	}, nil
+}
+
+// Start starts listening on the four addresses, or the two of the primary IP
+// address and the control channel in the distributed mode, and returns.
+// TCP and TLS listeners are started as configured.
+func (s *Server) Start() error {
+	for i, addr := range s.addrs {
+		if !s.isLocal(i) {
+			continue
+		}
+		s.log.Infof("listening on %s", addr.String())
+		conn, err := s.net.ListenUDP("udp", addr)
+		if err != nil {
+			s.Close() // nolint:errcheck,gosec
+			return err
+		}
+		s.conns[i] = conn
+	}
+
+	if err := s.listenStreams(); err != nil {
+		s.Close() // nolint:errcheck,gosec
+		return err
+	}
+
+	if s.peer != nil {
+		if err := s.peer.listen(s.net); err != nil {
+			s.Close() // nolint:errcheck,gosec
+			return err
+		}
+		s.log.Infof("control channel on %s, peer at %s",
+			s.peer.conn.LocalAddr().String(), s.peer.peerAddr.String())
+
+		s.wg.Add(1)
+		go s.controlLoop()
+	}
+
+	for i, conn := range s.conns {
+		if conn != nil {
+			s.wg.Add(1)
+			go s.readLoop(i)
+		}
+	}
+	return nil
+}
+
+func (s *Server) isOwnIP(ip net.IP) bool {
+	for i, addr := range s.addrs {
+		if s.isLocal(i) && addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells whether the socket of index is on this host.
+func (s *Server) isLocal(index int) bool {
+	return s.peer == nil || index < 2
+}
+
+// Serve runs the server until ctx is done, then shuts it down gracefully.
+// It returns an error if the server failed to start or the self-check, or
+// stopped for other reasons than ctx.
+func (s *Server) Serve(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	if err := s.SelfCheck(ctx); err != nil {
+		if ctx.Err() != nil {
+			// Canceled before the check completed; not a failure.
+			s.log.Info("shutting down")
+			return s.Close()
+		}
+		s.Close() // nolint:errcheck,gosec
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		s.log.Info("shutting down")
+		return s.Close()
+	case err := <-s.errCh:
+		s.Close() // nolint:errcheck,gosec
+		return err
+	}
+}
+
+// Close stops the server, and waits for the sockets to be read no more.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	conns := s.conns[:]
+	if s.peer != nil && s.peer.conn != nil {
+		conns = append(conns, s.peer.conn)
+	}
+
+	err := s.closeStreams()
+	for _, conn := range conns {
+		if conn != nil {
+			err2 := conn.Close()
+			if err2 != nil && err == nil {
+				err = err2
+			}
+		}
+	}
+
+	s.wg.Wait()
+	return err
+}
+
+// Reports the error that stopped a loop to Serve. The first one is enough to
+// stop the server, so the others are dropped rather than blocking the loops,
+// which Close waits for.
+func (s *Server) fail(err error) {
+	select {
+	case s.errCh <- err:
+	default:
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *Server) readLoop(index int) {
+	defer s.wg.Done()
+
+	conn := s.conns[index]
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			s.log.Errorf("readLoop: %s", err.Error())
+			s.fail(err)
+			return
+		}
+
+		s.log.Debugf("received %d bytes from %s", n, from.String())
+
+		received := time.Now()
+		sent, err := s.handleMessage(&request{
+			transport: transportUDP,
+			index:     index,
+			from:      from,
+		}, buf[:n])
+		if err != nil {
+			s.log.Warnf("readLoop: failed to handle message from %s: %s",
+				from.String(), err.Error())
+		}
+		if sent {
+			s.metrics.observeLatency(time.Since(received))
+		}
+	}
+}
+
+// Handles a message of req. Tells whether a response was sent.
+func (s *Server) handleMessage(req *request, raw []byte) (bool, error) {
+	// Requests sent by SelfCheck are not filtered.
+	srcIP, _ := ipPort(req.from)
+	if !s.isSelfCheck(req.from, raw) {
+		if reason := s.filter.check(srcIP); reason != dropNone {
+			s.log.Debugf("dropped message from %s: %s", req.from.String(), reason.String())
+			s.metrics.countFiltered(reason)
+			return false, nil
+		}
+	}
+
+	if !stun.IsMessage(raw) {
+		s.log.Debug("not a STUN message. dropping...")
+		s.metrics.countDropped(dropLabelNotSTUN)
+		return false, nil
+	}
+
+	m := &stun.Message{Raw: append([]byte{}, raw...)}
+	if err := m.Decode(); err != nil {
+		s.log.Debugf("failed to decode: %s", err.Error())
+		s.metrics.countDecodeFailure()
+		// The header is intact as stun.IsMessage told.
+		var transactionID [stun.TransactionIDSize]byte
+		copy(transactionID[:], raw[8:20])
+		return s.sendError(req, transactionID, stun.MethodBinding, stun.CodeBadRequest)
+	}
+
+	if m.Contains(stun.AttrFingerprint) {
+		if err := stun.Fingerprint.Check(m); err != nil {
+			s.log.Debugf("bad FINGERPRINT: %s. dropping...", err.Error())
+			s.metrics.countDropped(dropLabelBadFingerprint)
+			return false, nil
+		}
+	}
+
+	if m.Type.Class != stun.ClassRequest {
+		s.log.Debug("not a request. dropping...")
+		s.metrics.countDropped(dropLabelNotRequest)
+		return false, nil
+	}
+
+	if m.Type.Method != stun.MethodBinding {
+		s.log.Debugf("unsupported method: %s", m.Type.Method.String())
+		s.metrics.countDropped(dropLabelNotBinding)
+		return s.sendError(req, m.TransactionID, m.Type.Method, stun.CodeBadRequest)
+	}
+
+	return s.handleBindingRequest(req, m)
+}
+
+func (s *Server) handleBindingRequest(req *request, m *stun.Message) (bool, error) {
+	s.log.Debugf("received BindingRequest from %s over %s", req.from.String(), req.transport.String())
+	s.metrics.countRequest(req.transport, req.index)
+
+	// Authenticate before anything else. (RFC 8489 Section 9)
+	var cred *credential
+	if s.auth != nil {
+		if !s.isSelfCheck(req.from, m.Raw) {
+			var code stun.ErrorCode
+			var challenge []stun.Setter
+			cred, code, challenge = s.auth.verify(m)
+			if cred == nil {
+				s.log.Debugf("authentication failed: %d", int(code))
+				s.metrics.countAuthFailure()
+				return s.sendError(req, m.TransactionID, m.Type.Method, code, challenge...)
+			}
+		}
+	}
+
+	// Comprehension-required attributes must be understood.
+	var unknown stun.UnknownAttributes
+	for _, a := range m.Attributes {
+		if a.Type.Required() && !isKnownAttr(a.Type) {
+			unknown = append(unknown, a.Type)
+		}
+	}
+	if len(unknown) > 0 {
+		s.log.Debugf("unknown attributes: %s", unknown.String())
+		return s.sendError(req, m.TransactionID, m.Type.Method,
+			stun.CodeUnknownAttribute, unknown)
+	}
+
+	index := req.index
+
+	// Check CHANGE-REQUEST
+	changeReq := attr.ChangeRequest{}
+	if err := changeReq.GetFrom(m); err == nil {
+		s.log.Debugf("CHANGE-REQUEST: changeIP=%v changePort=%v",
+			changeReq.ChangeIP, changeReq.ChangePort)
+		s.metrics.countChangeRequest(changeReq.ChangeIP, changeReq.ChangePort)
+		if req.stream != nil && (changeReq.ChangeIP || changeReq.ChangePort) {
+			// Responses over TCP can only be sent on the connection.
+			// (RFC 5780 Section 7.2)
+			return s.sendError(req, m.TransactionID, m.Type.Method, stun.CodeBadRequest)
+		}
+		if s.ignoreCR {
+			s.log.Debug("ignoring CHANGE-REQUEST")
+		} else {
+			if changeReq.ChangeIP {
+				index ^= 0x2
+			}
+			if changeReq.ChangePort {
+				index ^= 0x1
+			}
+		}
+	} else if err != stun.ErrAttributeNotFound {
+		return s.sendError(req, m.TransactionID, m.Type.Method, stun.CodeBadRequest)
+	}
+
+	// Check RESPONSE-PORT, which is for UDP only. (RFC 5780 Section 7.5)
+	fromIP, fromPort := ipPort(req.from)
+	to := req.from
+	respPort := attr.ResponsePort{}
+	err := respPort.GetFrom(m)
+	hasResponsePort := err == nil
+	if hasResponsePort && req.stream == nil {
+		s.log.Debugf("RESPONSE-PORT: %d", respPort.Port)
+		to = &net.UDPAddr{IP: fromIP, Port: respPort.Port}
+	} else if hasResponsePort || err != stun.ErrAttributeNotFound {
+		return s.sendError(req, m.TransactionID, m.Type.Method, stun.CodeBadRequest)
+	}
+
+	// PADDING is not allowed with RESPONSE-PORT. (RFC 5780 Section 6.1)
+	padding := attr.Padding{}
+	hasPadding := padding.GetFrom(m) == nil
+	if hasPadding && hasResponsePort {
+		return s.sendError(req, m.TransactionID, m.Type.Method, stun.CodeBadRequest)
+	}
+
+	var setters []stun.Setter
+	if s.legacy {
+		setters = append(setters, &attr.MappedAddress{
+			Address: attr.Address{IP: fromIP, Port: fromPort},
+		})
+	} else {
+		setters = append(setters, &stun.XORMappedAddress{
+			IP:   fromIP,
+			Port: fromPort,
+		})
+	}
+
+	addrs := s.addrsOf(req.transport)
+
+	// The address differing in both IP and port from the one the request
+	// was received on. (RFC 5780 Section 7.4, RFC 3489 Section 11.2.3)
+	other := attr.Address{
+		IP:   addrs[req.index^0x3].IP,
+		Port: addrs[req.index^0x3].Port,
+	}
+
+	for _, t := range s.altAttrs {
+		switch t {
+		case attr.TypeChangedAddress:
+			setters = append(setters, &attr.ChangedAddress{Address: other})
+		case attr.TypeOtherAddress:
+			setters = append(setters, &attr.OtherAddress{Address: other})
+			// The address the response is sent from. (RFC 5780 Section 7.3)
+			setters = append(setters, &attr.ResponseOrigin{
+				Address: attr.Address{IP: addrs[index].IP, Port: addrs[index].Port},
+			})
+		}
+	}
+
+	// Pad the response as much as the request. (RFC 5780 Section 6.1)
+	if hasPadding {
+		setters = append(setters, &padding)
+	}
+
+	msg, err := stun.Build(s.makeAttrs(m.TransactionID, stun.BindingSuccess, cred, setters...)...)
+	if err != nil {
+		return false, err
+	}
+
+	// RESPONSE-PORT lets a spoofed request direct the response to any port
+	// of the victim, which must gain nothing in size from it. Clients pad
+	// such requests instead. (RFC 5780 Section 7.5)
+	if hasResponsePort && cred == nil && len(msg.Raw) > len(m.Raw) {
+		s.log.Debugf("response of %d bytes to RESPONSE-PORT exceeds the request of %d bytes. dropping...",
+			len(msg.Raw), len(m.Raw))
+		s.metrics.countDropped(dropLabelResponseTooLarge)
+		return false, nil
+	}
+
+	return s.send(req, index, msg.Raw, to)
+}
+
+// Sends an error response to req from the socket it was received on.
+func (s *Server) sendError(
+	req *request,
+	transactionID [stun.TransactionIDSize]byte,
+	method stun.Method,
+	code stun.ErrorCode,
+	additional ...stun.Setter) (bool, error) {
+	s.log.Debugf("sending error %d to %s", int(code), req.from.String())
+
+	setters := append([]stun.Setter{code}, additional...)
+	msg, err := stun.Build(s.makeAttrs(transactionID,
+		stun.NewType(method, stun.ClassErrorResponse), nil, setters...)...)
+	if err != nil {
+		return false, err
+	}
+
+	return s.send(req, req.index, msg.Raw, req.from)
+}
+
+// Sends raw to the client from the socket of index, which may be the peer's,
+// or on the connection of req for TCP and TLS.
+func (s *Server) send(req *request, index int, raw []byte, to net.Addr) (bool, error) {
+	if s.maxSize > 0 && len(raw) > s.maxSize {
+		s.log.Debugf("response of %d bytes exceeds the limit. dropping...", len(raw))
+		s.metrics.countDropped(dropLabelResponseTooLarge)
+		return false, nil
+	}
+
+	var err error
+	if req.stream != nil {
+		err = s.writeStream(req.stream, raw)
+	} else if s.isLocal(index) {
+		_, err = s.conns[index].WriteTo(raw, to)
+	} else {
+		err = s.forward(index, raw, to)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Server) makeAttrs(
+	transactionID [stun.TransactionIDSize]byte,
+	msgType stun.MessageType,
+	cred *credential,
+	additional ...stun.Setter) []stun.Setter {
+	attrs := append([]stun.Setter{&stun.Message{TransactionID: transactionID}, msgType}, additional...)
+	if len(s.software) > 0 {
+		attrs = append(attrs, s.software)
+	}
+	if cred != nil {
+		attrs = append(attrs, cred.setters()...)
+	}
+	return append(attrs, stun.Fingerprint)
+}
+
+func isKnownAttr(t stun.AttrType) bool {
+	switch t {
+	case attr.TypeChangeRequest, attr.TypeResponsePort, attr.TypePadding,
+		stun.AttrUsername, stun.AttrMessageIntegrity, stun.AttrRealm, stun.AttrNonce,
+		attr.TypeMessageIntegritySHA256:
+		return true
+	}
+	return false
+}
+
+// Splits "host:port" into host and port, defaulting the port if missing.
+func splitHostPort(hostPort string, defaultPort int) (string, string, error) {
+	if host, port, err := net.SplitHostPort(hostPort); err == nil {
+		return host, port, nil
+	}
+	host := strings.Trim(hostPort, "[]")
+	if len(host) == 0 {
+		return "", "", fmt.Errorf("invalid address: %q", hostPort)
+	}
+	return host, strconv.Itoa(defaultPort), nil
+}
@@ -0,0 +1,522 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEnv struct {
+	wan       *vnet.Router
+	serverNet *vnet.Net
+	client    net.PacketConn
+}
+
+func (e *testEnv) close() {
+	e.client.Close() // nolint:errcheck,gosec
+	e.wan.Stop()     // nolint:errcheck,gosec
+}
+
+// Sends raw to the server and waits for a response.
+func (e *testEnv) exchange(raw []byte, to string) (*stun.Message, net.Addr, error) {
+	toAddr, err := net.ResolveUDPAddr("udp", to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err = e.client.WriteTo(raw, toAddr); err != nil {
+		return nil, nil, err
+	}
+
+	err = e.client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+	n, from, err := e.client.ReadFrom(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := &stun.Message{Raw: buf[:n]}
+	if err = m.Decode(); err != nil {
+		return nil, nil, err
+	}
+	return m, from, nil
+}
+
+func buildEnv(configure func(config *Config)) (*testEnv, *Server, error) {
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "0.0.0.0/0",
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serverNet := vnet.NewNet(&vnet.NetConfig{
+		StaticIPs: []string{"1.2.3.4", "1.2.3.5"},
+	})
+	if err = wan.AddNet(serverNet); err != nil {
+		return nil, nil, err
+	}
+
+	clientNet := vnet.NewNet(&vnet.NetConfig{
+		StaticIPs: []string{"5.6.7.8"},
+	})
+	if err = wan.AddNet(clientNet); err != nil {
+		return nil, nil, err
+	}
+
+	if err = wan.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	config := &Config{
+		PrimaryAddress:   "1.2.3.4",
+		SecondaryAddress: "1.2.3.5",
+		Net:              serverNet,
+		LoggerFactory:    loggerFactory,
+	}
+	if configure != nil {
+		configure(config)
+	}
+
+	server, err := NewServer(config)
+	if err != nil {
+		wan.Stop() // nolint:errcheck,gosec
+		return nil, nil, err
+	}
+
+	client, err := clientNet.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		wan.Stop() // nolint:errcheck,gosec
+		return nil, nil, err
+	}
+
+	return &testEnv{wan: wan, serverNet: serverNet, client: client}, server, nil
+}
+
+func TestChangedAddress(t *testing.T) {
+	env, server, err := buildEnv(func(config *Config) {
+		config.AlternateAddressAttrs = []stun.AttrType{AttrTypeOtherAddress, AttrTypeChangedAddress}
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer env.close()
+
+	if !assert.NoError(t, server.Start(), "should succeed") {
+		return
+	}
+	defer server.Close() // nolint:errcheck,gosec
+
+	testCases := []struct {
+		to       string
+		expected string
+	}{
+		{"1.2.3.4:3478", "1.2.3.5:3479"},
+		{"1.2.3.4:3479", "1.2.3.5:3478"},
+		{"1.2.3.5:3478", "1.2.3.4:3479"},
+		{"1.2.3.5:3479", "1.2.3.4:3478"},
+	}
+
+	for _, tc := range testCases {
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		res, _, err := env.exchange(req.Raw, tc.to)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		// Relative to the address the request was received on, as is
+		// OTHER-ADDRESS
+		var changed attr.ChangedAddress
+		assert.NoError(t, changed.GetFrom(res), "should succeed")
+		assert.Equal(t, tc.expected, changed.String(), "should match")
+
+		var other attr.OtherAddress
+		assert.NoError(t, other.GetFrom(res), "should succeed")
+		assert.Equal(t, tc.expected, other.String(), "should match")
+	}
+}
+
+func TestServer(t *testing.T) {
+	env, server, err := buildEnv(func(config *Config) {
+		config.Software = "go-nats test"
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer env.close()
+
+	if !assert.NoError(t, server.Start(), "should succeed") {
+		return
+	}
+	defer server.Close() // nolint:errcheck,gosec
+
+	t.Run("Binding request", func(t *testing.T) {
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		res, from, err := env.exchange(req.Raw, "1.2.3.4:3478")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assert.Equal(t, stun.BindingSuccess, res.Type, "should match")
+		assert.Equal(t, req.TransactionID, res.TransactionID, "should match")
+		assert.Equal(t, "1.2.3.4:3478", from.String(), "should match")
+
+		var mapped stun.XORMappedAddress
+		assert.NoError(t, mapped.GetFrom(res), "should succeed")
+		assert.Equal(t, "5.6.7.8", mapped.IP.String(), "should match")
+
+		var other attr.OtherAddress
+		assert.NoError(t, other.GetFrom(res), "should succeed")
+		assert.Equal(t, "1.2.3.5:3479", other.String(), "should match")
+
+		var origin attr.ResponseOrigin
+		assert.NoError(t, origin.GetFrom(res), "should succeed")
+		assert.Equal(t, "1.2.3.4:3478", origin.String(), "should match")
+
+		assert.False(t, res.Contains(attr.TypeChangedAddress), "should not be sent")
+		assert.True(t, res.Contains(stun.AttrSoftware), "should be sent")
+		assert.NoError(t, stun.Fingerprint.Check(res), "should succeed")
+	})
+
+	t.Run("CHANGE-REQUEST", func(t *testing.T) {
+		testCases := []struct {
+			changeIP   bool
+			changePort bool
+			expected   string
+		}{
+			{false, true, "1.2.3.4:3479"},
+			{true, false, "1.2.3.5:3478"},
+			{true, true, "1.2.3.5:3479"},
+		}
+
+		for _, tc := range testCases {
+			req := stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+				&attr.ChangeRequest{ChangeIP: tc.changeIP, ChangePort: tc.changePort})
+			res, from, err := env.exchange(req.Raw, "1.2.3.4:3478")
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			assert.Equal(t, tc.expected, from.String(), "should match")
+
+			var origin attr.ResponseOrigin
+			assert.NoError(t, origin.GetFrom(res), "should succeed")
+			assert.Equal(t, tc.expected, origin.String(), "should match")
+
+			// Still relative to the address the request was received on
+			var other attr.OtherAddress
+			assert.NoError(t, other.GetFrom(res), "should succeed")
+			assert.Equal(t, "1.2.3.5:3479", other.String(), "should match")
+		}
+	})
+
+	t.Run("PADDING", func(t *testing.T) {
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+			&attr.Padding{Length: 256})
+		res, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		var padding attr.Padding
+		assert.NoError(t, padding.GetFrom(res), "should succeed")
+		assert.Equal(t, 256, padding.Length, "should match")
+	})
+
+	t.Run("Bad FINGERPRINT", func(t *testing.T) {
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		req.Raw[len(req.Raw)-1] ^= 0xff
+
+		_, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+		assert.Error(t, err, "should be dropped")
+	})
+
+	t.Run("Malformed request", func(t *testing.T) {
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		// An attribute claiming more bytes than the message has
+		raw := append(req.Raw, 0x00, 0x03, 0x00, 0x08)
+		binary.BigEndian.PutUint16(raw[2:4], 4)
+
+		res, _, err := env.exchange(raw, "1.2.3.4:3478")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assertErrorCode(t, res, stun.CodeBadRequest)
+		assert.Equal(t, req.TransactionID, res.TransactionID, "should match")
+	})
+
+	t.Run("Unknown attribute", func(t *testing.T) {
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		req.Add(stun.AttrType(0x0030), []byte{1, 2, 3, 4})
+		req.WriteHeader()
+
+		res, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assertErrorCode(t, res, stun.CodeUnknownAttribute)
+
+		var unknown stun.UnknownAttributes
+		assert.NoError(t, unknown.GetFrom(res), "should succeed")
+		assert.Equal(t, stun.UnknownAttributes{stun.AttrType(0x0030)}, unknown, "should match")
+	})
+
+	t.Run("PADDING with RESPONSE-PORT", func(t *testing.T) {
+		req := stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+			&attr.Padding{Length: 256},
+			&attr.ResponsePort{Port: 5000})
+
+		res, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assertErrorCode(t, res, stun.CodeBadRequest)
+	})
+
+	t.Run("Unsupported method", func(t *testing.T) {
+		req := stun.MustBuild(stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassRequest))
+
+		res, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		assertErrorCode(t, res, stun.CodeBadRequest)
+	})
+}
+
+func assertErrorCode(t *testing.T, res *stun.Message, code stun.ErrorCode) {
+	assert.Equal(t, stun.ClassErrorResponse, res.Type.Class, "should be an error")
+
+	var errCode stun.ErrorCodeAttribute
+	assert.NoError(t, errCode.GetFrom(res), "should succeed")
+	assert.Equal(t, code, errCode.Code, "should match")
+}
+
+func TestServerConfig(t *testing.T) {
+	t.Run("Same IP addresses", func(t *testing.T) {
+		_, err := NewServer(&Config{
+			PrimaryAddress:   "1.2.3.4:3478",
+			SecondaryAddress: "1.2.3.4:3479",
+		})
+		assert.Error(t, err, "should fail")
+	})
+
+	t.Run("Same ports", func(t *testing.T) {
+		_, err := NewServer(&Config{
+			PrimaryAddress:   "1.2.3.4:3478",
+			SecondaryAddress: "1.2.3.5:3478",
+		})
+		assert.Error(t, err, "should fail")
+	})
+
+	t.Run("Unsupported alternate address attribute", func(t *testing.T) {
+		_, err := NewServer(&Config{
+			PrimaryAddress:        "1.2.3.4",
+			SecondaryAddress:      "1.2.3.5",
+			AlternateAddressAttrs: []stun.AttrType{stun.AttrSoftware},
+		})
+		assert.Error(t, err, "should fail")
+	})
+}
+
+func TestServe(t *testing.T) {
+	env, server, err := buildEnv(nil)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer env.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(ctx)
+	}()
+
+	// Wait until the server responds
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	for i := 0; i < 10; i++ {
+		if _, _, err = env.exchange(req.Raw, "1.2.3.4:3478"); err == nil {
+			break
+		}
+	}
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	cancel()
+
+	select {
+	case err = <-done:
+		assert.NoError(t, err, "should succeed")
+	case <-time.After(time.Second):
+		assert.Fail(t, "Serve should return")
+		return
+	}
+
+	// The addresses are free again
+	conn, err := env.serverNet.ListenPacket("udp4", "1.2.3.4:3478")
+	if assert.NoError(t, err, "should succeed") {
+		conn.Close() // nolint:errcheck,gosec
+	}
+
+	_, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+	assert.Error(t, err, "should not respond")
+}
+
+func TestSelfCheck(t *testing.T) {
+	env, server, err := buildEnv(nil)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer env.close()
+
+	assert.Error(t, server.SelfCheck(context.Background()), "should fail before Start")
+
+	if !assert.NoError(t, server.Start(), "should succeed") {
+		return
+	}
+
+	assert.NoError(t, server.SelfCheck(context.Background()), "should succeed")
+
+	// A socket no longer answering
+	server.conns[3].Close() // nolint:errcheck,gosec
+	assert.Error(t, server.SelfCheck(context.Background()), "should fail")
+
+	server.Close() // nolint:errcheck,gosec
+}
+
+func TestServerProtection(t *testing.T) {
+	run := func(t *testing.T, configure func(config *Config), test func(env *testEnv, server *Server)) {
+		env, server, err := buildEnv(configure)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer env.close()
+
+		if !assert.NoError(t, server.Start(), "should succeed") {
+			return
+		}
+		defer server.Close() // nolint:errcheck,gosec
+
+		test(env, server)
+	}
+
+	t.Run("Denied source", func(t *testing.T) {
+		run(t, func(config *Config) {
+			config.DenyCIDRs = []string{"5.6.7.0/24"}
+		}, func(env *testEnv, _ *Server) {
+			req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+			_, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+			assert.Error(t, err, "should be dropped")
+		})
+	})
+
+	t.Run("Source not allowed", func(t *testing.T) {
+		run(t, func(config *Config) {
+			config.AllowCIDRs = []string{"10.0.0.0/8"}
+		}, func(env *testEnv, server *Server) {
+			// The server's own requests are not filtered
+			assert.NoError(t, server.SelfCheck(context.Background()), "should succeed")
+
+			req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+			_, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+			assert.Error(t, err, "should be dropped")
+
+			// Nor are others from the server's IP address, which may be
+			// spoofed
+			conn, err := env.serverNet.ListenPacket("udp4", "1.2.3.5:0")
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			own := &testEnv{client: conn}
+			defer conn.Close() // nolint:errcheck,gosec
+			_, _, err = own.exchange(req.Raw, "1.2.3.4:3478")
+			assert.Error(t, err, "should be dropped")
+		})
+	})
+
+	t.Run("Per-source rate", func(t *testing.T) {
+		run(t, func(config *Config) {
+			config.PerSourceRate = 0.01
+			config.PerSourceBurst = 2
+		}, func(env *testEnv, _ *Server) {
+			for i := 0; i < 2; i++ {
+				req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+				_, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+				assert.NoError(t, err, "should succeed")
+			}
+
+			// Also limits requests to the other sockets
+			req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+			_, _, err := env.exchange(req.Raw, "1.2.3.5:3479")
+			assert.Error(t, err, "should be dropped")
+		})
+	})
+
+	t.Run("Response size", func(t *testing.T) {
+		run(t, func(config *Config) {
+			config.MaxResponseSize = 200
+		}, func(env *testEnv, _ *Server) {
+			req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+			_, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+			assert.NoError(t, err, "should succeed")
+
+			req = stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+				&attr.Padding{Length: 256})
+			_, _, err = env.exchange(req.Raw, "1.2.3.4:3478")
+			assert.Error(t, err, "should be dropped")
+		})
+	})
+
+	t.Run("Default response size", func(t *testing.T) {
+		run(t, nil, func(env *testEnv, _ *Server) {
+			req := stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+				&attr.Padding{Length: 1400})
+			_, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+			assert.Error(t, err, "should be dropped")
+		})
+	})
+
+	t.Run("Redirected response", func(t *testing.T) {
+		run(t, nil, func(env *testEnv, _ *Server) {
+			// Redirected to the port of the client itself, to receive it
+			port := env.client.LocalAddr().(*net.UDPAddr).Port
+
+			req := stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+				&attr.ResponsePort{Port: port})
+			_, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+			assert.Error(t, err, "should be dropped as larger than the request")
+
+			req = stun.MustBuild(stun.TransactionID, stun.BindingRequest,
+				&attr.ResponsePort{Port: port},
+				stun.NewSoftware(strings.Repeat(" ", 120)))
+			res, _, err := env.exchange(req.Raw, "1.2.3.4:3478")
+			if assert.NoError(t, err, "should succeed") {
+				assert.True(t, len(res.Raw) <= len(req.Raw), "should not be larger than the request")
+			}
+		})
+	})
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	defaultTLSPrimaryPort   = 5349
+	defaultTLSSecondaryPort = 5350
+	defaultMaxConnections   = 1000
+	streamIdleTimeout       = 30 * time.Second
+	streamWriteTimeout      = 5 * time.Second
+	minAcceptRetryDelay     = 5 * time.Millisecond
+	maxAcceptRetryDelay     = time.Second
+	stunHeaderSize          = 20
+)
+
+// transport is the transport a request was received over.
+type transport int
+
+const (
+	transportUDP transport = iota
+	transportTCP
+	transportTLS
+	numTransports
+)
+
+func (t transport) String() string {
+	switch t {
+	case transportUDP:
+		return "udp"
+	case transportTCP:
+		return "tcp"
+	case transportTLS:
+		return "tls"
+	default:
+		return "unknown"
+	}
+}
+
+// request is where a message came from, and how to respond to it.
+type request struct {
+	transport transport
+	index     int      // index of the socket or the listener received on
+	from      net.Addr // *net.UDPAddr or *net.TCPAddr
+	stream    net.Conn // connection received on, for TCP and TLS
+}
+
+func ipPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+func (s *Server) listensOn(t transport) bool {
+	switch t {
+	case transportUDP:
+		return true
+	case transportTCP:
+		return s.tcp
+	case transportTLS:
+		return s.tlsConfig != nil
+	}
+	return false
+}
+
+// Returns the four addresses the server listens on over t.
+func (s *Server) addrsOf(t transport) *[4]*net.UDPAddr {
+	if t == transportTLS {
+		return &s.tlsAddrs
+	}
+	return &s.addrs
+}
+
+// Listens on TCP and TLS as configured, on the addresses of this host.
+func (s *Server) listenStreams() error {
+	for t := transportTCP; t < numTransports; t++ {
+		if !s.listensOn(t) {
+			continue
+		}
+
+		for i, addr := range s.addrsOf(t) {
+			if !s.isLocal(i) {
+				continue
+			}
+
+			tcpAddr := &net.TCPAddr{IP: addr.IP, Port: addr.Port}
+			var ln net.Listener
+			var err error
+			if t == transportTLS {
+				ln, err = tls.Listen("tcp", tcpAddr.String(), s.tlsConfig)
+			} else {
+				ln, err = net.ListenTCP("tcp", tcpAddr)
+			}
+			if err != nil {
+				return err
+			}
+			s.log.Infof("listening on %s over %s", tcpAddr.String(), t.String())
+
+			s.mutex.Lock()
+			s.listeners = append(s.listeners, ln)
+			s.mutex.Unlock()
+
+			s.wg.Add(1)
+			go s.acceptLoop(ln, t, i)
+		}
+	}
+	return nil
+}
+
+func (s *Server) acceptLoop(ln net.Listener, t transport, index int) {
+	defer s.wg.Done()
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			// Such as running out of file descriptors. Retried with a
+			// backoff, as connections may be closed in the meantime.
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				if delay == 0 {
+					delay = minAcceptRetryDelay
+				} else if delay *= 2; delay > maxAcceptRetryDelay {
+					delay = maxAcceptRetryDelay
+				}
+				s.log.Warnf("acceptLoop: %s; retrying in %v", err.Error(), delay)
+				time.Sleep(delay)
+				continue
+			}
+			s.log.Errorf("acceptLoop: %s", err.Error())
+			s.fail(err)
+			return
+		}
+		delay = 0
+
+		// Filtered before anything is read, or the TLS handshake is done.
+		// Unlike over UDP, the source address cannot be spoofed, and the
+		// connections of SelfCheck are let in by it.
+		if ip, _ := ipPort(conn.RemoteAddr()); !s.isOwnIP(ip) {
+			if reason := s.filter.check(ip); reason != dropNone {
+				s.log.Debugf("dropped %s connection from %s: %s",
+					t.String(), conn.RemoteAddr().String(), reason.String())
+				s.metrics.countFiltered(reason)
+				conn.Close() // nolint:errcheck,gosec
+				continue
+			}
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close() // nolint:errcheck,gosec
+			return
+		}
+		if len(s.streams) >= s.maxConns {
+			s.mutex.Unlock()
+			s.log.Debugf("too many connections. closing %s connection from %s",
+				t.String(), conn.RemoteAddr().String())
+			s.metrics.countDropped(dropLabelTooManyConns)
+			conn.Close() // nolint:errcheck,gosec
+			continue
+		}
+		s.streams[conn] = struct{}{}
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go s.streamLoop(conn, t, index)
+	}
+}
+
+// Reads the STUN messages framed as defined in RFC 5389 Section 7.2.2, that
+// is, one after another as the header tells their length.
+func (s *Server) streamLoop(conn net.Conn, t transport, index int) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.streams, conn)
+		s.mutex.Unlock()
+		conn.Close() // nolint:errcheck,gosec
+	}()
+
+	s.log.Debugf("%s connection from %s", t.String(), conn.RemoteAddr().String())
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(streamIdleTimeout)); err != nil {
+			return
+		}
+
+		if _, err := io.ReadFull(conn, buf[:stunHeaderSize]); err != nil {
+			s.log.Debugf("%s connection from %s closed: %s",
+				t.String(), conn.RemoteAddr().String(), err.Error())
+			return
+		}
+
+		if !stun.IsMessage(buf[:stunHeaderSize]) {
+			// The framing is lost.
+			s.log.Debug("not a STUN message. closing...")
+			s.metrics.countDropped(dropLabelNotSTUN)
+			return
+		}
+
+		size := stunHeaderSize + int(binary.BigEndian.Uint16(buf[2:4]))
+		if size > len(buf) {
+			s.log.Debugf("message of %d bytes is too large. closing...", size)
+			s.metrics.countDecodeFailure()
+			return
+		}
+
+		if _, err := io.ReadFull(conn, buf[stunHeaderSize:size]); err != nil {
+			return
+		}
+
+		received := time.Now()
+		sent, err := s.handleMessage(&request{
+			transport: t,
+			index:     index,
+			from:      conn.RemoteAddr(),
+			stream:    conn,
+		}, buf[:size])
+		if err != nil {
+			s.log.Warnf("streamLoop: failed to handle message from %s: %s",
+				conn.RemoteAddr().String(), err.Error())
+			return
+		}
+		if sent {
+			s.metrics.observeLatency(time.Since(received))
+		}
+	}
+}
+
+func (s *Server) writeStream(conn net.Conn, raw []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+		return err
+	}
+	_, err := conn.Write(raw)
+	return err
+}
+
+// Closes the listeners and the connections accepted.
+func (s *Server) closeStreams() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var err error
+	for _, ln := range s.listeners {
+		if err2 := ln.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	for conn := range s.streams {
+		conn.Close() // nolint:errcheck,gosec
+	}
+	return err
+}
+
+// Reads a STUN message from a stream.
+func readStreamMessage(r io.Reader) (*stun.Message, error) {
+	header := make([]byte, stunHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !stun.IsMessage(header) {
+		return nil, fmt.Errorf("not a STUN message")
+	}
+
+	raw := make([]byte, stunHeaderSize+int(binary.BigEndian.Uint16(header[2:4])))
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[stunHeaderSize:]); err != nil {
+		return nil, err
+	}
+
+	m := &stun.Message{Raw: raw}
+	if err := m.Decode(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enobufs/go-nats/internal/attr"
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-nats test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Sends a Binding request with the setters over conn, and reads the response.
+func streamExchange(conn net.Conn, setters ...stun.Setter) (*stun.Message, error) {
+	req, err := stun.Build(append([]stun.Setter{stun.TransactionID, stun.BindingRequest}, setters...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write(req.Raw); err != nil {
+		return nil, err
+	}
+
+	return readStreamMessage(conn)
+}
+
+func TestStreamListeners(t *testing.T) {
+	// Needs two loopback addresses, which are not available everywhere.
+	conn, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("127.0.0.2 is not available")
+	}
+	conn.Close() // nolint:errcheck,gosec
+
+	cert, err := newTestCertificate()
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	server, err := NewServer(&Config{
+		PrimaryAddress:   "127.0.0.1:34780",
+		SecondaryAddress: "127.0.0.2:34781",
+		TCP:              true,
+		TLSConfig:        &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSPrimaryPort:   34790,
+		TLSSecondaryPort: 34791,
+		LoggerFactory:    logging.NewDefaultLoggerFactory(),
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, server.Start(), "should succeed") {
+		return
+	}
+	defer server.Close() // nolint:errcheck,gosec
+
+	assert.NoError(t, server.SelfCheck(context.Background()), "should succeed")
+
+	t.Run("TCP", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:34780")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer conn.Close() // nolint:errcheck,gosec
+
+		// Several requests on the same connection
+		for i := 0; i < 3; i++ {
+			res, err := streamExchange(conn)
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			var mapped stun.XORMappedAddress
+			assert.NoError(t, mapped.GetFrom(res), "should succeed")
+			assert.Equal(t, conn.LocalAddr().String(), mapped.String(), "should match")
+
+			var other attr.OtherAddress
+			assert.NoError(t, other.GetFrom(res), "should succeed")
+			assert.Equal(t, "127.0.0.2:34781", other.String(), "should match")
+
+			var origin attr.ResponseOrigin
+			assert.NoError(t, origin.GetFrom(res), "should succeed")
+			assert.Equal(t, "127.0.0.1:34780", origin.String(), "should match")
+		}
+	})
+
+	t.Run("CHANGE-REQUEST over TCP", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:34780")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer conn.Close() // nolint:errcheck,gosec
+
+		res, err := streamExchange(conn, &attr.ChangeRequest{ChangeIP: true})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assertErrorCode(t, res, stun.CodeBadRequest)
+
+		res, err = streamExchange(conn, &attr.ResponsePort{Port: 5000})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assertErrorCode(t, res, stun.CodeBadRequest)
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		pool.AddCert(leaf)
+
+		conn, err := tls.Dial("tcp", "127.0.0.2:34791", &tls.Config{RootCAs: pool})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer conn.Close() // nolint:errcheck,gosec
+
+		res, err := streamExchange(conn)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+
+		var other attr.OtherAddress
+		assert.NoError(t, other.GetFrom(res), "should succeed")
+		assert.Equal(t, "127.0.0.1:34790", other.String(), "should match")
+
+		var origin attr.ResponseOrigin
+		assert.NoError(t, origin.GetFrom(res), "should succeed")
+		assert.Equal(t, "127.0.0.2:34791", origin.String(), "should match")
+	})
+
+	t.Run("Not STUN", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:34780")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer conn.Close() // nolint:errcheck,gosec
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		assert.NoError(t, err, "should succeed")
+
+		// The connection is closed by the server.
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)), "should succeed")
+		_, err = conn.Read(make([]byte, 100))
+		assert.Error(t, err, "should be closed")
+	})
+}
+
+// Tells whether the server closed conn, as opposed to leaving it open
+// without a response.
+func isClosedByServer(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		return false
+	}
+	_, err := conn.Read(make([]byte, 100))
+	nerr, ok := err.(net.Error)
+	return err != nil && !(ok && nerr.Timeout())
+}
+
+func TestStreamLimits(t *testing.T) {
+	// Needs three loopback addresses, which are not available everywhere.
+	for _, ip := range []string{"127.0.0.2", "127.0.0.3"} {
+		conn, err := net.ListenPacket("udp4", ip+":0")
+		if err != nil {
+			t.Skip(ip + " is not available")
+		}
+		conn.Close() // nolint:errcheck,gosec
+	}
+
+	server, err := NewServer(&Config{
+		PrimaryAddress:   "127.0.0.1:34880",
+		SecondaryAddress: "127.0.0.2:34881",
+		TCP:              true,
+		MaxConnections:   2,
+		DenyCIDRs:        []string{"127.0.0.3/32"},
+		LoggerFactory:    logging.NewDefaultLoggerFactory(),
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, server.Start(), "should succeed") {
+		return
+	}
+	defer server.Close() // nolint:errcheck,gosec
+
+	t.Run("Denied at accept", func(t *testing.T) {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.3")}}
+		conn, err := dialer.Dial("tcp", "127.0.0.1:34880")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer conn.Close() // nolint:errcheck,gosec
+
+		// Closed without anything sent
+		assert.True(t, isClosedByServer(conn), "should be closed")
+	})
+
+	t.Run("Max connections", func(t *testing.T) {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close() // nolint:errcheck,gosec
+			}
+		}()
+
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial("tcp", "127.0.0.1:34880")
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			conns = append(conns, conn)
+
+			_, err = streamExchange(conn)
+			assert.NoError(t, err, "should succeed")
+		}
+
+		conn, err := net.Dial("tcp", "127.0.0.1:34880")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer conn.Close() // nolint:errcheck,gosec
+		assert.True(t, isClosedByServer(conn), "should be closed")
+
+		// Room is made as a connection is closed
+		conns[0].Close() // nolint:errcheck,gosec
+		time.Sleep(100 * time.Millisecond)
+		conn, err = net.Dial("tcp", "127.0.0.1:34880")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer conn.Close() // nolint:errcheck,gosec
+		_, err = streamExchange(conn)
+		assert.NoError(t, err, "should succeed")
+	})
+
+	t.Run("Negative", func(t *testing.T) {
+		_, err := NewServer(&Config{
+			PrimaryAddress:   "127.0.0.1",
+			SecondaryAddress: "127.0.0.2",
+			MaxConnections:   -1,
+		})
+		assert.Error(t, err, "should fail")
+	})
+}
+
+// fakeListener returns the errors given one after another from Accept.
+type fakeListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+type temporaryError struct{}
+
+func (e temporaryError) Error() string   { return "too many open files" }
+func (e temporaryError) Timeout() bool   { return false }
+func (e temporaryError) Temporary() bool { return true }
+
+func TestAcceptErrors(t *testing.T) {
+	server, err := NewServer(&Config{
+		PrimaryAddress:   "1.2.3.4",
+		SecondaryAddress: "1.2.3.5",
+		Net:              vnet.NewNet(&vnet.NetConfig{}),
+		LoggerFactory:    logging.NewDefaultLoggerFactory(),
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	t.Run("Temporary errors", func(t *testing.T) {
+		ln := &fakeListener{errs: []error{temporaryError{}, temporaryError{}, io.ErrUnexpectedEOF}}
+		server.wg.Add(1)
+		server.acceptLoop(ln, transportTCP, 0)
+
+		// Retried until the permanent error
+		assert.Empty(t, ln.errs, "should have accepted again")
+		select {
+		case err := <-server.errCh:
+			assert.Equal(t, io.ErrUnexpectedEOF, err, "should match")
+		default:
+			t.Error("should have failed")
+		}
+	})
+
+	t.Run("More errors than the channel holds", func(t *testing.T) {
+		for i := 0; i < 13; i++ {
+			server.wg.Add(1)
+			go server.acceptLoop(&fakeListener{errs: []error{io.ErrUnexpectedEOF}}, transportTCP, 0)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			server.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("loops should not block")
+		}
+	})
+}
+
+func TestStreamListenersOnVNet(t *testing.T) {
+	_, err := NewServer(&Config{
+		PrimaryAddress:   "1.2.3.4",
+		SecondaryAddress: "1.2.3.5",
+		TCP:              true,
+		Net:              vnet.NewNet(&vnet.NetConfig{}),
+	})
+	assert.Error(t, err, "should fail")
+}